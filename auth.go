@@ -0,0 +1,164 @@
+package gotransport
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var ErrUnauthorized = errors.New("transport: unauthorized")
+
+const (
+	// default max time of the authentication
+	authTimeout = 10 * time.Second
+	// size of the HMAC challenge
+	challengeSize = 32
+)
+
+// Authenticator authenticates the peer with the first frames, after the
+// handshake and before OnConnected. A transport that fails is closed
+// with the error, and the close handlers are not called.
+type Authenticator interface {
+	// Begin is called first, e.g. to send a challenge.
+	Begin(t Transport) error
+
+	// Next is called with each frame read until it is done or fails,
+	// the identity is attached to the transport, see Transport.Identity.
+	Next(t Transport, packet Protocol) (identity interface{}, done bool, err error)
+}
+
+// authenticate runs the Authenticator within the AuthTimeout.
+func (t *transport) authenticate() error {
+	auth := t.opts.Authenticator
+	if auth == nil {
+		return nil
+	}
+	timeout := t.opts.AuthTimeout
+	if timeout <= 0 {
+		timeout = authTimeout
+	}
+	t.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer t.conn.SetReadDeadline(time.Time{})
+	atomic.StoreInt32(&t.authenticating, 1)
+	defer atomic.StoreInt32(&t.authenticating, 0)
+
+	if err := auth.Begin(t); err != nil {
+		return err
+	}
+	for {
+		packet, err := t.next(t.reader)
+		if err != nil {
+			return err
+		}
+		if t.handleHeartbeat(packet) || t.handleCredit(packet) {
+			continue
+		}
+		identity, done, err := auth.Next(t, packet)
+		t.consumed(packet)
+		if err != nil {
+			return err
+		}
+		if done {
+			t.identity = identity
+			return nil
+		}
+	}
+}
+
+// TokenAuth authenticates the peer with the token in the payload of its
+// first frame, verify returns the identity of the token or an error,
+// such as ErrUnauthorized.
+func TokenAuth(verify func(token []byte) (identity interface{}, err error)) Authenticator {
+	return &tokenAuth{verify: verify}
+}
+
+type tokenAuth struct {
+	verify func(token []byte) (interface{}, error)
+}
+
+func (a *tokenAuth) Begin(t Transport) error {
+	return nil
+}
+
+func (a *tokenAuth) Next(t Transport, packet Protocol) (interface{}, bool, error) {
+	identity, err := a.verify(packet.Payload())
+	return identity, true, err
+}
+
+// HMACChallenge authenticates the peer by challenge-response, the peer
+// must use HMACResponse. A random challenge is sent, the peer answers
+// with its id and the HMAC-SHA256 of the challenge under its key, which
+// is looked up by key. The id is the identity.
+func HMACChallenge(key func(id string) ([]byte, error)) Authenticator {
+	return &hmacChallenge{key: key}
+}
+
+type hmacChallenge struct {
+	key func(id string) ([]byte, error)
+}
+
+func (a *hmacChallenge) Begin(t Transport) error {
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	t.Set(challengeKey, challenge)
+	_, err := t.Write(challenge)
+	return err
+}
+
+func (a *hmacChallenge) Next(t Transport, packet Protocol) (interface{}, bool, error) {
+	// response is [ id ][ 0 ][ mac ]
+	i := bytes.IndexByte(packet.Payload(), 0)
+	if i < 0 {
+		return nil, true, ErrUnauthorized
+	}
+	id, mac := string(packet.Payload()[:i]), packet.Payload()[i+1:]
+	key, err := a.key(id)
+	if err != nil {
+		return nil, true, err
+	}
+	challenge, _ := t.Get(challengeKey)
+	t.Delete(challengeKey)
+	if !hmac.Equal(mac, hmacSum(key, challenge.([]byte))) {
+		return nil, true, ErrUnauthorized
+	}
+	return id, true, nil
+}
+
+// HMACResponse answers the challenge of HMACChallenge with the id and key.
+func HMACResponse(id string, key []byte) Authenticator {
+	return &hmacResponse{id: id, key: key}
+}
+
+type hmacResponse struct {
+	id  string
+	key []byte
+}
+
+func (a *hmacResponse) Begin(t Transport) error {
+	return nil
+}
+
+func (a *hmacResponse) Next(t Transport, packet Protocol) (interface{}, bool, error) {
+	if len(packet.Payload()) != challengeSize {
+		return nil, true, ErrUnauthorized
+	}
+	response := append([]byte(a.id), 0)
+	response = append(response, hmacSum(a.key, packet.Payload())...)
+	_, err := t.Write(response)
+	return nil, true, err
+}
+
+// challengeKey is the session key of the challenge sent.
+const challengeKey = "gotransport.challenge"
+
+func hmacSum(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,77 @@
+package gotransport
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuth(t *testing.T) {
+	keys := map[string][]byte{"alice": []byte("secret")}
+	challenge := HMACChallenge(func(id string) ([]byte, error) {
+		if key, ok := keys[id]; ok {
+			return key, nil
+		}
+		return nil, ErrUnauthorized
+	})
+
+	pipe := func(client Authenticator, connected chan Transport) *transport {
+		opts1, opts2 := MakeOptions(), MakeOptions()
+		WithAuth(client, time.Second)(opts1)
+		WithAuth(challenge, time.Second)(opts2)
+		WithConnected(func(transport Transport) bool {
+			transport.Set("role", "user")
+			connected <- transport
+			return true
+		})(opts2)
+		c1, c2 := net.Pipe()
+		NewTransport(context.Background(), c1, opts1).LoopAsync()
+		return NewTransport(context.Background(), c2, opts2).LoopAsync()
+	}
+
+	connected := make(chan Transport, 1)
+	pipe(HMACResponse("alice", []byte("secret")), connected)
+	select {
+	case t2 := <-connected:
+		assert(t2.Identity() == "alice")
+		role, ok := t2.Get("role")
+		assert(ok && role == "user")
+		_, ok = t2.Get(challengeKey)
+		assert(!ok)
+		t2.Close()
+	case <-time.After(time.Second):
+		t.Fatal("not connected")
+	}
+
+	// wrong key
+	t2 := pipe(HMACResponse("alice", []byte("guess")), connected)
+	<-t2.Context().Done()
+	assert(t2.Err() == ErrUnauthorized)
+	assert(len(connected) == 0)
+
+	// the client sends a token
+	opts := MakeOptions()
+	WithAuth(TokenAuth(func(token []byte) (interface{}, error) {
+		if string(token) != "token" {
+			return nil, ErrUnauthorized
+		}
+		return "bob", nil
+	}), 0)(opts)
+	WithConnected(func(transport Transport) bool {
+		connected <- transport
+		return true
+	})(opts)
+	c1, c2 := net.Pipe()
+	t1 := NewTransport(context.Background(), c1, nil)
+	defer t1.Close()
+	NewTransport(context.Background(), c2, opts).LoopAsync()
+	t1.WriteString("token")
+	select {
+	case t2 := <-connected:
+		assert(t2.Identity() == "bob")
+		t2.Close()
+	case <-time.After(time.Second):
+		t.Fatal("not connected")
+	}
+}
@@ -4,24 +4,46 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"io"
+	"math/rand"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/luweimy/gotransport"
+	"github.com/luweimy/gotransport/rudp"
+	"github.com/luweimy/gotransport/websocket"
 )
 
 var (
 	ErrMultipleConnectCalls = errors.New("server multiple connect calls")
+	ErrDisconnected         = errors.New("client: disconnected")
+	ErrQueueFull            = errors.New("client: reconnect queue full")
+)
+
+const (
+	defaultReconnectMinDelay = 100 * time.Millisecond
+	defaultReconnectMaxDelay = 30 * time.Second
 )
 
 type Client struct {
 	opts *gotransport.Options
 	ctx  context.Context
 
-	gotransport.Transport
-	mu sync.Mutex
+	mu           sync.Mutex
+	t            gotransport.Transport
+	network      string
+	address      string
+	closed       bool
+	reconnecting bool
+	flushing     bool // the queue is written after reconnecting
+	queue        []gotransport.Protocol
 }
 
+// Client is the transport of its current connection.
+var _ gotransport.Transport = (*Client)(nil)
+
 func Dial(network, address string, opts ...gotransport.OptionFunc) (*Client, error) {
 	client := New(opts...)
 	if err := client.Connect(network, address); err != nil {
@@ -45,27 +67,424 @@ func (c *Client) Options(opts ...gotransport.OptionFunc) {
 	}
 }
 
+// Connect dials the address, the network may be a stream one such as "tcp",
+// or a datagram one such as "udp", whose packets are sent a datagram each,
+// or "rudp" or "kcp", a reliable stream over UDP, see package rudp,
+// or "ws" or "wss" whose address is the url, see package websocket.
 func (c *Client) Connect(network, address string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.Transport != nil && !c.Transport.IsClosed() {
+	if c.reconnecting || (c.t != nil && !c.t.IsClosed()) {
 		return ErrMultipleConnectCalls
 	}
-	var (
-		conn net.Conn
-		err  error
-	)
-	if c.opts.ConfigTLS != nil {
-		conn, err = tls.Dial(network, address, c.opts.ConfigTLS)
-	} else {
-		conn, err = net.Dial(network, address)
-	}
+	c.network, c.address = network, address
+	conn, err := c.dial()
 	if err != nil {
 		return err
 	}
+	t := gotransport.NewTransport(c.ctx, conn, c.opts)
+	// handshake here, so that a failed one is returned
+	if err := t.Handshake(); err != nil {
+		return err
+	}
+	c.closed = false
+	c.t = t.LoopAsync()
+	if c.opts.Reconnect != nil {
+		go c.monitor(c.t)
+	}
+
+	return nil
+}
+
+// Transport returns the transport of the current connection,
+// nil before Connect. It replaces the embedded Transport field, which
+// was replaced on reconnecting without a lock.
+func (c *Client) Transport() gotransport.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// ProtocolMake makes a packet of the configured protocol.
+func (c *Client) ProtocolMake() gotransport.Protocol {
+	t := c.Transport()
+	if t == nil {
+		return c.opts.Factory()
+	}
+	return t.ProtocolMake()
+}
+
+// Write writes data to the connection, see WritePacket.
+func (c *Client) Write(b []byte) (n int, err error) {
+	packet := c.ProtocolMake()
+	packet.SetPayload(b)
+	return c.WritePacket(packet)
+}
+
+func (c *Client) WriteString(s string) (n int, err error) {
+	return c.Write([]byte(s))
+}
+
+// WritePacket writes the packet to the current connection.
+// While reconnecting it fails with ErrDisconnected, or if
+// ReconnectOptions.QueueSize is set the packet is queued and
+// written once reconnected, in which case n is 0.
+func (c *Client) WritePacket(packet gotransport.Protocol) (n int, err error) {
+	return c.WritePacketContext(context.Background(), packet)
+}
+
+// WritePacketContext is like WritePacket, but the write is aborted when ctx is done.
+func (c *Client) WritePacketContext(ctx context.Context, packet gotransport.Protocol) (n int, err error) {
+	c.mu.Lock()
+	if c.reconnecting || c.flushing {
+		defer c.mu.Unlock()
+		if c.opts.Reconnect.QueueSize <= 0 {
+			return 0, ErrDisconnected
+		}
+		if len(c.queue) >= c.opts.Reconnect.QueueSize {
+			return 0, ErrQueueFull
+		}
+		c.queue = append(c.queue, packet)
+		return 0, nil
+	}
+	t := c.t
+	c.mu.Unlock()
+
+	if t == nil {
+		return 0, ErrDisconnected
+	}
+	return t.WritePacketContext(ctx, packet)
+}
+
+// Send encodes the message with the MessageCodec and writes it, see WritePacket.
+func (c *Client) Send(msg interface{}) error {
+	if c.opts.MessageCodec == nil {
+		return gotransport.ErrNoMessageCodec
+	}
+	packet := c.ProtocolMake()
+	if err := c.opts.MessageCodec.Marshal(msg, packet); err != nil {
+		return err
+	}
+	_, err := c.WritePacket(packet)
+	return err
+}
+
+// Close closes the connection and stops reconnecting.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.queue = nil
+	t := c.t
+	c.mu.Unlock()
+
+	if t == nil {
+		return nil
+	}
+	return t.Close()
+}
+
+// The methods below are the ones of the transport of the current connection.
+
+func (c *Client) ID() uint64 {
+	if t := c.Transport(); t != nil {
+		return t.ID()
+	}
+	return 0
+}
+
+func (c *Client) IsClosed() bool {
+	if t := c.Transport(); t != nil {
+		return t.IsClosed()
+	}
+	return true
+}
+
+// CloseWithError closes the connection with the error, and stops reconnecting.
+func (c *Client) CloseWithError(err error) error {
+	c.mu.Lock()
+	c.closed = true
+	c.queue = nil
+	t := c.t
+	c.mu.Unlock()
+	if t == nil {
+		return nil
+	}
+	return t.CloseWithError(err)
+}
+
+// Shutdown shuts down the connection gracefully, and stops reconnecting.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.closed = true
+	c.queue = nil
+	t := c.t
+	c.mu.Unlock()
+	if t == nil {
+		return nil
+	}
+	return t.Shutdown(ctx)
+}
+
+func (c *Client) Peer() net.Addr {
+	if t := c.Transport(); t != nil {
+		return t.Peer()
+	}
+	return nil
+}
 
-	c.Transport = gotransport.NewTransport(c.ctx, conn, c.opts).LoopAsync()
+func (c *Client) Host() net.Addr {
+	if t := c.Transport(); t != nil {
+		return t.Host()
+	}
+	return nil
+}
 
+func (c *Client) Done() <-chan error {
+	if t := c.Transport(); t != nil {
+		return t.Done()
+	}
 	return nil
 }
+
+func (c *Client) Context() context.Context {
+	if t := c.Transport(); t != nil {
+		return t.Context()
+	}
+	return c.ctx
+}
+
+func (c *Client) Err() error {
+	if t := c.Transport(); t != nil {
+		return t.Err()
+	}
+	return nil
+}
+
+func (c *Client) Negotiated() *gotransport.Negotiation {
+	if t := c.Transport(); t != nil {
+		return t.Negotiated()
+	}
+	return nil
+}
+
+func (c *Client) Identity() interface{} {
+	if t := c.Transport(); t != nil {
+		return t.Identity()
+	}
+	return nil
+}
+
+func (c *Client) Set(key string, value interface{}) {
+	if t := c.Transport(); t != nil {
+		t.Set(key, value)
+	}
+}
+
+func (c *Client) Get(key string) (interface{}, bool) {
+	if t := c.Transport(); t != nil {
+		return t.Get(key)
+	}
+	return nil, false
+}
+
+func (c *Client) Delete(key string) {
+	if t := c.Transport(); t != nil {
+		t.Delete(key)
+	}
+}
+
+func (c *Client) OpenStream() (io.WriteCloser, error) {
+	if t := c.Transport(); t != nil {
+		return t.OpenStream()
+	}
+	return nil, ErrDisconnected
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	if c.network == "rudp" || c.network == "kcp" {
+		conn, err := rudp.Dial("udp", c.address, nil)
+		if err != nil {
+			return nil, err
+		}
+		if c.opts.ConfigTLS != nil {
+			return tls.Client(conn, c.opts.ConfigTLS), nil
+		}
+		return conn, nil
+	}
+	if c.network == "ws" || c.network == "wss" {
+		address := c.address
+		if !strings.Contains(address, "://") {
+			address = c.network + "://" + address
+		}
+		conn, err := websocket.Dial(address, &websocket.Config{TLS: c.opts.ConfigTLS})
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	if c.opts.ConfigTLS != nil {
+		return tls.Dial(c.network, c.address, c.opts.ConfigTLS)
+	}
+	return net.Dial(c.network, c.address)
+}
+
+// monitor waits the transport to be closed then starts reconnecting.
+func (c *Client) monitor(t gotransport.Transport) {
+	<-t.Context().Done()
+	reason := t.Err()
+
+	c.mu.Lock()
+	// a connection rejected by OnConnected would be rejected again
+	if c.closed || c.t != t || errors.Is(reason, gotransport.ErrRejected) {
+		c.mu.Unlock()
+		return
+	}
+	c.reconnecting = true
+	c.mu.Unlock()
+
+	c.reconnect(t, reason)
+}
+
+// reconnect dials until connected, OnReconnected is called with the
+// reason of the disconnection.
+func (c *Client) reconnect(old gotransport.Transport, cause error) {
+	r := c.opts.Reconnect
+	reason := cause
+	for attempt := 1; r.MaxAttempts <= 0 || attempt <= r.MaxAttempts; attempt++ {
+		if c.opts.OnReconnecting != nil {
+			c.opts.OnReconnecting(old, attempt, reason)
+		}
+		select {
+		case <-time.After(backoff(r, attempt)):
+		case <-c.ctx.Done():
+			c.stopReconnecting()
+			return
+		}
+
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			break
+		}
+
+		conn, err := c.dial()
+		if err != nil {
+			reason = err
+			continue
+		}
+		connected := make(chan struct{})
+		nt := gotransport.NewTransport(c.ctx, conn, c.connectOptions(connected))
+		if err := nt.Handshake(); err != nil {
+			reason = err
+			continue
+		}
+		t := nt.LoopAsync()
+		// reconnected once authenticated and accepted by OnConnected
+		select {
+		case <-connected:
+		case <-t.Context().Done():
+			reason = t.Err()
+			if errors.Is(reason, gotransport.ErrRejected) {
+				c.stopReconnecting()
+				return
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			t.Close()
+			return
+		}
+		c.t = t
+		c.reconnecting = false
+		c.flushing = len(c.queue) > 0
+		c.mu.Unlock()
+		c.flush(t)
+
+		if c.opts.OnReconnected != nil {
+			c.opts.OnReconnected(t, attempt, cause)
+		}
+		go c.monitor(t)
+		return
+	}
+
+	c.stopReconnecting()
+}
+
+// connectOptions copies the options, whose OnConnected closes connected
+// once the user's one accepts the transport.
+func (c *Client) connectOptions(connected chan struct{}) *gotransport.Options {
+	opts := *c.opts
+	onConnected := opts.OnConnected
+	opts.OnConnected = func(t gotransport.Transport) bool {
+		if onConnected != nil && !onConnected(t) {
+			return false
+		}
+		close(connected)
+		return true
+	}
+	return &opts
+}
+
+// flush writes the queued packets, the writes made meanwhile are queued
+// after them to keep the order. The packets not written are queued
+// again for the next connection.
+func (c *Client) flush(t gotransport.Transport) {
+	for {
+		c.mu.Lock()
+		queue := c.queue
+		c.queue = nil
+		if len(queue) == 0 || c.closed {
+			c.flushing = false
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+
+		for i, packet := range queue {
+			if _, err := t.WritePacket(packet); err != nil {
+				c.mu.Lock()
+				if !c.closed {
+					c.queue = append(queue[i:], c.queue...)
+				}
+				c.flushing = false
+				c.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// stopReconnecting gives up, the queued writes are dropped.
+func (c *Client) stopReconnecting() {
+	c.mu.Lock()
+	c.reconnecting = false
+	c.queue = nil
+	c.mu.Unlock()
+}
+
+// backoff returns the exponential delay with jitter of the attempt.
+func backoff(r *gotransport.ReconnectOptions, attempt int) time.Duration {
+	minDelay, maxDelay := r.MinDelay, r.MaxDelay
+	if minDelay <= 0 {
+		minDelay = defaultReconnectMinDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultReconnectMaxDelay
+	}
+	delay := minDelay
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if r.Jitter > 0 {
+		delay += time.Duration(float64(delay) * r.Jitter * (rand.Float64()*2 - 1))
+	}
+	return delay
+}
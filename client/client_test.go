@@ -3,7 +3,9 @@ package client
 import (
 	"fmt"
 	"log"
+	"net"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -44,3 +46,132 @@ func TestClient(t *testing.T) {
 
 	}
 }
+
+func TestReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	errorCheck(err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	reconnected := make(chan struct{}, 1)
+	client := New(
+		gotransport.WithReconnect(gotransport.ReconnectOptions{MinDelay: 10 * time.Millisecond, QueueSize: 1}),
+		gotransport.WithReconnected(func(transport gotransport.Transport, attempt int, err error) {
+			reconnected <- struct{}{}
+		}),
+	)
+	errorCheck(client.Connect("tcp", ln.Addr().String()))
+	defer client.Close()
+
+	// drop the first connection, the client should dial again
+	(<-accepted).Close()
+	conn := <-accepted
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("client not reconnected")
+	}
+
+	_, err = client.WriteString("ping")
+	errorCheck(err)
+	p := gotransport.PacketProtocol()
+	_, err = p.ReadFrom(conn)
+	errorCheck(err)
+	if string(p.Payload()) != "ping" {
+		t.Fatalf("payload = %q, want ping", p.Payload())
+	}
+}
+
+func TestReconnectRejected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	errorCheck(err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	reconnecting := make(chan struct{}, 1)
+	client := New(
+		gotransport.WithReconnect(gotransport.ReconnectOptions{MinDelay: time.Millisecond}),
+		gotransport.WithReconnecting(func(transport gotransport.Transport, attempt int, err error) {
+			reconnecting <- struct{}{}
+		}),
+		gotransport.WithConnected(func(transport gotransport.Transport) bool {
+			return false
+		}),
+	)
+	errorCheck(client.Connect("tcp", ln.Addr().String()))
+	defer client.Close()
+
+	<-client.Context().Done()
+	if client.Err() != gotransport.ErrRejected {
+		t.Fatalf("err = %v, want %v", client.Err(), gotransport.ErrRejected)
+	}
+	select {
+	case <-reconnecting:
+		t.Fatal("reconnecting after a rejection")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReconnectRejectedAgain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	errorCheck(err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	var connects int32
+	reconnected := make(chan struct{}, 1)
+	client := New(
+		gotransport.WithReconnect(gotransport.ReconnectOptions{MinDelay: time.Millisecond}),
+		gotransport.WithReconnected(func(transport gotransport.Transport, attempt int, err error) {
+			reconnected <- struct{}{}
+		}),
+		// the reconnection is rejected
+		gotransport.WithConnected(func(transport gotransport.Transport) bool {
+			return atomic.AddInt32(&connects, 1) == 1
+		}),
+	)
+	errorCheck(client.Connect("tcp", ln.Addr().String()))
+	defer client.Close()
+	first := client.Transport()
+
+	(<-accepted).Close()
+	conn := <-accepted
+	defer conn.Close()
+	select {
+	case <-reconnected:
+		t.Fatal("reconnected with a rejected transport")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if atomic.LoadInt32(&connects) != 2 {
+		t.Fatalf("connects = %d, want 2", connects)
+	}
+	if client.Transport() != first {
+		t.Fatal("the rejected transport replaced the current one")
+	}
+}
@@ -0,0 +1,179 @@
+package gotransport
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+)
+
+var ErrPoolClosed = errors.New("transport: worker pool closed")
+
+// DispatchMode decides where OnMessage is called.
+type DispatchMode int
+
+const (
+	DispatchInline  DispatchMode = iota // in the read loop, a slow handler stalls the connection
+	DispatchOrdered                     // in a goroutine per transport, packets keep their order
+	DispatchPool                        // in a WorkerPool shared by transports, packets may be reordered
+)
+
+var (
+	defaultPoolOnce sync.Once
+	defaultPool     *WorkerPool
+)
+
+// DefaultPool returns the WorkerPool of DispatchPool mode without
+// Options.Pool, its workers are 8 per CPU, and it's never closed.
+func DefaultPool() *WorkerPool {
+	defaultPoolOnce.Do(func() {
+		defaultPool = NewWorkerPool(8*runtime.NumCPU(), SendQueueSize)
+	})
+	return defaultPool
+}
+
+// WorkerPool runs message handlers with a bounded number of goroutines,
+// it can be shared by many transports to cap the total concurrency.
+type WorkerPool struct {
+	tasks   chan func()
+	closing chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+func NewWorkerPool(workers, queueSize int) *WorkerPool {
+	if workers <= 0 {
+		workers = 1
+	}
+	p := &WorkerPool{
+		tasks:   make(chan func(), queueSize),
+		closing: make(chan struct{}),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues the task, it blocks while the queue is full.
+func (p *WorkerPool) Submit(ctx context.Context, task func()) error {
+	select {
+	case <-p.closing:
+		return ErrPoolClosed
+	default:
+	}
+	select {
+	case p.tasks <- task:
+		return nil
+	case <-p.closing:
+		return ErrPoolClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the workers after the queued tasks are done.
+func (p *WorkerPool) Close() {
+	p.once.Do(func() {
+		close(p.closing)
+	})
+	p.wg.Wait()
+}
+
+func (p *WorkerPool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case task := <-p.tasks:
+			task()
+		case <-p.closing:
+			for {
+				select {
+				case task := <-p.tasks:
+					task()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// startDispatch composes the message handler with the middlewares,
+// and starts the goroutine of DispatchOrdered mode.
+func (t *transport) startDispatch() {
+	t.onMessage = t.opts.OnMessage
+	if t.opts.OnTypedMessage != nil && t.opts.MessageCodec != nil {
+		t.onMessage = typedMessageHandler(t.opts.MessageCodec, t.opts.OnTypedMessage, t.opts.OnMessage)
+	}
+	if t.onMessage == nil {
+		return
+	}
+	for i := len(t.opts.Middlewares) - 1; i >= 0; i-- {
+		t.onMessage = t.opts.Middlewares[i](t.onMessage)
+	}
+	if t.opts.DispatchMode != DispatchOrdered {
+		return
+	}
+	size := t.opts.DispatchQueueSize
+	if size <= 0 {
+		size = SendQueueSize
+	}
+	t.dispatchCh = make(chan Protocol, size)
+	go func() {
+		for packet := range t.dispatchCh {
+			t.handle(packet)
+		}
+	}()
+}
+
+// stopDispatch lets the ordered goroutine exit after the queued packets.
+func (t *transport) stopDispatch() {
+	if t.dispatchCh != nil {
+		close(t.dispatchCh)
+	}
+}
+
+// dispatch hands the packet to OnMessage according to the DispatchMode,
+// it blocks while the dispatch queue is full, which pauses the reading.
+func (t *transport) dispatch(packet Protocol) error {
+	if t.onMessage == nil {
+		t.consumed(packet)
+		return nil
+	}
+	switch {
+	case t.dispatchCh != nil:
+		t.handlers.Add(1)
+		select {
+		case t.dispatchCh <- packet:
+			return nil
+		case <-t.ctx.Done():
+			t.handlers.Done()
+			return t.ctx.Err()
+		}
+	case t.opts.DispatchMode == DispatchPool:
+		pool := t.opts.Pool
+		if pool == nil {
+			pool = DefaultPool()
+		}
+		t.handlers.Add(1)
+		err := pool.Submit(t.ctx, func() {
+			t.handle(packet)
+		})
+		if err != nil {
+			t.handlers.Done()
+		}
+		return err
+	default:
+		t.handlers.Add(1)
+		t.handle(packet)
+		return nil
+	}
+}
+
+func (t *transport) handle(packet Protocol) {
+	defer t.handlers.Done()
+	t.notify(packet)
+	t.consumed(packet)
+}
@@ -0,0 +1,129 @@
+package gotransport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+)
+
+var ErrWouldBlock = errors.New("transport: out of credits")
+
+// flowControl reports whether the credit-based flow control is enabled,
+// it needs a protocol carrying the credits as control frames.
+func (t *transport) flowControl() bool {
+	if t.opts.FlowControl == nil || t.opts.FlowControl.Window <= 0 {
+		return false
+	}
+	_, ok := t.opts.Factory().(ControlProtocol)
+	return ok
+}
+
+// cost returns the credits taken by the packet, the control frames
+// are free.
+func (t *transport) cost(packet Protocol) int64 {
+	if cp, ok := packet.(ControlProtocol); ok {
+		if _, ok := cp.Control(); ok {
+			return 0
+		}
+	}
+	if t.opts.FlowControl.Unit == FlowBytes {
+		return int64(len(packet.Payload()))
+	}
+	return 1
+}
+
+// acquireCredits takes the credits of the packet, it waits for the peer
+// to grant more, or fails with ErrWouldBlock if NonBlocking. A packet is
+// sent as long as any credit is left, so the credits in bytes may be
+// overrun by one packet. While authenticating the packets are sent on
+// credit, as the grant of the peer isn't read yet.
+func (t *transport) acquireCredits(ctx context.Context, packet Protocol) error {
+	if !t.flow {
+		return nil
+	}
+	cost := t.cost(packet)
+	if cost == 0 {
+		return nil
+	}
+	for {
+		t.creditMu.Lock()
+		if t.credits > 0 || atomic.LoadInt32(&t.authenticating) == 1 {
+			t.credits -= cost
+			t.creditMu.Unlock()
+			return nil
+		}
+		granted := t.granted
+		t.creditMu.Unlock()
+		if t.opts.FlowControl.NonBlocking {
+			return ErrWouldBlock
+		}
+		select {
+		case <-granted:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.closing:
+			return ErrClosed
+		}
+	}
+}
+
+// releaseCredits gives back the credits of a packet not sent.
+func (t *transport) releaseCredits(packet Protocol) {
+	if t.flow {
+		t.addCredits(t.cost(packet))
+	}
+}
+
+func (t *transport) addCredits(credits int64) {
+	t.creditMu.Lock()
+	t.credits += credits
+	// wake up all the writers waiting
+	close(t.granted)
+	t.granted = make(chan struct{})
+	t.creditMu.Unlock()
+}
+
+// handleCredit adds the credits granted by the peer, it reports whether
+// the packet was a credit frame and is consumed.
+func (t *transport) handleCredit(packet Protocol) bool {
+	if !t.flow {
+		return false
+	}
+	if kind, ok := packet.(ControlProtocol).Control(); !ok || kind != ControlCredit {
+		return false
+	}
+	credits, n := binary.Uvarint(packet.Payload())
+	if n <= 0 {
+		return true
+	}
+	t.addCredits(int64(credits))
+	return true
+}
+
+// consumed counts the packet handled, the credits are granted back
+// to the peer once half of the window is consumed.
+func (t *transport) consumed(packet Protocol) {
+	if !t.flow {
+		return
+	}
+	t.creditMu.Lock()
+	t.consumedCredits += t.cost(packet)
+	grant := t.consumedCredits
+	if grant < int64(t.opts.FlowControl.Window+1)/2 {
+		t.creditMu.Unlock()
+		return
+	}
+	t.consumedCredits = 0
+	t.creditMu.Unlock()
+	t.grantCredits(grant)
+}
+
+// grantCredits gives the peer credits to send.
+func (t *transport) grantCredits(credits int64) {
+	var buf [binary.MaxVarintLen64]byte
+	packet := t.ProtocolMake()
+	packet.(ControlProtocol).SetControl(ControlCredit)
+	packet.SetPayload(buf[:binary.PutUvarint(buf[:], uint64(credits))])
+	t.enqueue(t.ctx, packet)
+}
@@ -0,0 +1,109 @@
+package gotransport
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFlowControl(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan []byte, 16)
+	opts := MakeOptions()
+	WithFlowControl(FlowControlOptions{Window: 4, NonBlocking: true})(opts)
+	WithMessage(func(transport Transport, packet Protocol) {
+		<-release
+		received <- packet.Payload()
+	})(opts)
+
+	c1, c2 := net.Pipe()
+	t1 := NewTransport(context.Background(), c1, opts).LoopAsync()
+	defer t1.Close()
+	NewTransport(context.Background(), c2, opts).LoopAsync()
+
+	// wait for the credits granted first
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := t1.WriteString("hello")
+		if err == nil {
+			break
+		}
+		assert(err == ErrWouldBlock)
+		if time.Now().After(deadline) {
+			t.Fatal("no credits granted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < 4; i++ {
+		_, err := t1.WriteString("hello")
+		assertErr(err)
+	}
+	_, err := t1.WriteString("hello")
+	assert(err == ErrWouldBlock)
+
+	// the credits are granted back as the handler returns
+	close(release)
+	for i := 0; i < 4; i++ {
+		<-received
+	}
+	deadline = time.Now().Add(time.Second)
+	for {
+		if _, err = t1.WriteString("hello"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("credits not granted back")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlowControlAuth(t *testing.T) {
+	key := []byte("secret")
+	received := make(chan string, 4)
+	pipe := func(client, server Authenticator) Transport {
+		opts1, opts2 := MakeOptions(), MakeOptions()
+		for _, opts := range []*Options{opts1, opts2} {
+			WithFlowControl(FlowControlOptions{Window: 1})(opts)
+		}
+		if client != nil {
+			WithAuth(client, time.Second)(opts1)
+		}
+		WithAuth(server, time.Second)(opts2)
+		WithMessage(func(transport Transport, packet Protocol) {
+			received <- string(packet.Payload())
+		})(opts2)
+		c1, c2 := net.Pipe()
+		t1 := NewTransport(context.Background(), c1, opts1).LoopAsync()
+		NewTransport(context.Background(), c2, opts2).LoopAsync()
+		return t1
+	}
+	check := func(t1 Transport) {
+		defer t1.Close()
+		// more messages than the window, the auth frames are granted back
+		for _, s := range []string{"a", "b", "c"} {
+			_, err := t1.WriteString(s)
+			assertErr(err)
+			select {
+			case got := <-received:
+				assert(got == s)
+			case <-time.After(time.Second):
+				t.Fatal("blocked by the flow control")
+			}
+		}
+	}
+
+	// the server writes the challenge before reading the grant of the client
+	check(pipe(HMACResponse("alice", key), HMACChallenge(func(string) ([]byte, error) {
+		return key, nil
+	})))
+
+	// the client writes the token with the grant of the server
+	t1 := pipe(nil, TokenAuth(func(token []byte) (interface{}, error) {
+		return string(token), nil
+	}))
+	_, err := t1.WriteString("token")
+	assertErr(err)
+	check(t1)
+}
@@ -0,0 +1,254 @@
+package gotransport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var ErrHandshake = errors.New("transport: handshake failed")
+
+const (
+	// the handshake frame is [ magic (4) ][ length (2) ][ hello in json ]
+	handshakeMagic = "GTHS"
+	// default max time of the handshake
+	handshakeTimeout = 10 * time.Second
+)
+
+// HandshakeError tells why the handshake failed, it matches ErrHandshake.
+type HandshakeError struct {
+	Reason string
+	Err    error // the I/O error, if any
+}
+
+func (e *HandshakeError) Error() string {
+	if e.Err != nil {
+		return "transport: handshake failed: " + e.Reason + ": " + e.Err.Error()
+	}
+	return "transport: handshake failed: " + e.Reason
+}
+
+func (e *HandshakeError) Is(target error) bool {
+	return target == ErrHandshake
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// Negotiation is the result of the handshake. Both peers compute the
+// same result from the two hellos, so no further round trip is needed.
+type Negotiation struct {
+	Version      uint16
+	Codec        string      // the common codec preferred by both, empty if neither lists any
+	Compression  Compression // the common compression preferred by both
+	MaxFrameSize int         // the smaller one of both max frame sizes
+	Extra        map[string]string
+	PeerExtra    map[string]string
+}
+
+// hello is what a peer announces in the handshake.
+type hello struct {
+	Version      uint16            `json:"version"`
+	MinVersion   uint16            `json:"min_version,omitempty"`
+	Codecs       []string          `json:"codecs,omitempty"`
+	Compressions []Compression     `json:"compressions,omitempty"`
+	MaxFrameSize int               `json:"max_frame_size,omitempty"`
+	Extra        map[string]string `json:"extra,omitempty"`
+}
+
+// Handshake runs the handshake of Options.Handshake on the raw conn,
+// before OnConnected. If it fails, the transport is closed and the
+// HandshakeError is returned. LoopSync and LoopAsync run it if it
+// hasn't been, calling it before lets the dialer get the error.
+// Writes wait for the handshake to complete.
+func (t *transport) Handshake() error {
+	t.handshakeOnce.Do(func() {
+		if t.opts.Handshake == nil {
+			return
+		}
+		if t.handshakeErr = t.handshake(); t.handshakeErr != nil {
+			t.reject(t.handshakeErr)
+			return
+		}
+		close(t.ready)
+	})
+	return t.handshakeErr
+}
+
+// Negotiated returns the result of the handshake,
+// nil if there is no handshake or it isn't complete.
+func (t *transport) Negotiated() *Negotiation {
+	select {
+	case <-t.ready:
+		return t.negotiation
+	default:
+		return nil
+	}
+}
+
+// handshaken reports whether the handshake is over.
+func (t *transport) handshaken() bool {
+	select {
+	case <-t.ready:
+		return true
+	case <-t.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *transport) handshake() error {
+	h := t.opts.Handshake
+	local := &hello{
+		Version:      h.Version,
+		MinVersion:   h.MinVersion,
+		Codecs:       h.Codecs,
+		Compressions: h.Compressions,
+		MaxFrameSize: h.MaxFrameSize,
+		Extra:        h.Extra,
+	}
+	if local.MaxFrameSize <= 0 {
+		local.MaxFrameSize = sizeLimit(t.opts.MaxPacketSize)
+	}
+	data, err := json.Marshal(local)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0xFFFF {
+		return &HandshakeError{Reason: "hello too large"}
+	}
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = handshakeTimeout
+	}
+	t.conn.SetDeadline(time.Now().Add(timeout))
+	defer t.conn.SetDeadline(time.Time{})
+
+	// both peers write first, so the write must not wait for the read
+	frame := make([]byte, 6, 6+len(data))
+	copy(frame, handshakeMagic)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(data)))
+	frame = append(frame, data...)
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := t.conn.Write(frame)
+		writeErr <- err
+	}()
+
+	var r io.Reader = t.conn
+	if t.datagram {
+		datagram := make([]byte, MaxDatagramSize)
+		n, err := t.conn.Read(datagram)
+		if err != nil {
+			return &HandshakeError{Reason: "read hello", Err: err}
+		}
+		r = bytes.NewReader(datagram[:n])
+	}
+	peer, err := readHello(r)
+	if err == nil {
+		if err = <-writeErr; err != nil {
+			err = &HandshakeError{Reason: "write hello", Err: err}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	negotiation, err := negotiate(local, peer)
+	if err != nil {
+		return err
+	}
+	t.negotiation = negotiation
+	atomic.StoreInt64(&t.maxPacketSize, int64(negotiation.MaxFrameSize))
+	return nil
+}
+
+func readHello(r io.Reader) (*hello, error) {
+	var header [6]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, &HandshakeError{Reason: "read hello", Err: err}
+	}
+	if string(header[:4]) != handshakeMagic {
+		return nil, &HandshakeError{Reason: "peer doesn't handshake"}
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[4:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, &HandshakeError{Reason: "read hello", Err: err}
+	}
+	peer := &hello{}
+	if err := json.Unmarshal(data, peer); err != nil {
+		return nil, &HandshakeError{Reason: "bad hello", Err: err}
+	}
+	return peer, nil
+}
+
+// negotiate computes the result, it is symmetric in the two hellos.
+func negotiate(local, peer *hello) (*Negotiation, error) {
+	version := local.Version
+	if peer.Version < version {
+		version = peer.Version
+	}
+	if version < local.MinVersion || version < peer.MinVersion {
+		return nil, &HandshakeError{Reason: "incompatible versions"}
+	}
+
+	n := &Negotiation{
+		Version:      version,
+		MaxFrameSize: local.MaxFrameSize,
+		Extra:        local.Extra,
+		PeerExtra:    peer.Extra,
+	}
+	if peer.MaxFrameSize > 0 && peer.MaxFrameSize < n.MaxFrameSize {
+		n.MaxFrameSize = peer.MaxFrameSize
+	}
+
+	i, ok := choose(len(local.Codecs), len(peer.Codecs),
+		func(i, j int) bool { return local.Codecs[i] == peer.Codecs[j] },
+		func(i, j int) bool { return local.Codecs[i] < local.Codecs[j] })
+	if !ok {
+		return nil, &HandshakeError{Reason: "no common codec"}
+	}
+	if i >= 0 {
+		n.Codec = local.Codecs[i]
+	}
+	i, ok = choose(len(local.Compressions), len(peer.Compressions),
+		func(i, j int) bool { return local.Compressions[i] == peer.Compressions[j] },
+		func(i, j int) bool { return local.Compressions[i] < local.Compressions[j] })
+	if !ok {
+		return nil, &HandshakeError{Reason: "no common compression"}
+	}
+	if i >= 0 {
+		n.Compression = local.Compressions[i]
+	}
+	return n, nil
+}
+
+// choose returns the index in the local list of the common item with the
+// smallest sum of the positions in both lists, ties are broken by less,
+// so both peers choose the same item. If either list is empty nothing is
+// chosen, which is ok and the index is -1.
+func choose(local, peer int, equal func(i, j int) bool, less func(i, j int) bool) (int, bool) {
+	if local == 0 || peer == 0 {
+		return -1, true
+	}
+	best, rank := -1, 0
+	for i := 0; i < local; i++ {
+		for j := 0; j < peer; j++ {
+			if !equal(i, j) {
+				continue
+			}
+			if best < 0 || i+j < rank || (i+j == rank && less(i, best)) {
+				best, rank = i, i+j
+			}
+			break
+		}
+	}
+	return best, best >= 0
+}
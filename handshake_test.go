@@ -0,0 +1,70 @@
+package gotransport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	pipe := func(h1, h2 HandshakeOptions, received chan []byte) (*transport, *transport) {
+		opts1, opts2 := MakeOptions(), MakeOptions()
+		WithHandshake(h1)(opts1)
+		WithHandshake(h2)(opts2)
+		WithMessage(func(transport Transport, packet Protocol) {
+			received <- packet.Payload()
+		})(opts2)
+		c1, c2 := net.Pipe()
+		return NewTransport(context.Background(), c1, opts1), NewTransport(context.Background(), c2, opts2)
+	}
+
+	received := make(chan []byte, 1)
+	t1, t2 := pipe(HandshakeOptions{
+		Version:      3,
+		Codecs:       []string{"msgpack", "json"},
+		Compressions: []Compression{CompressGzip, CompressFlate},
+		MaxFrameSize: 1024,
+	}, HandshakeOptions{
+		Version:      2,
+		MinVersion:   2,
+		Codecs:       []string{"json", "protobuf", "msgpack"},
+		Compressions: []Compression{CompressFlate},
+		Extra:        map[string]string{"name": "t2"},
+	}, received)
+	assert(t1.Negotiated() == nil)
+
+	// the write waits for the handshake
+	go t1.WriteString("hello")
+	t2.LoopAsync()
+	assertErr(t1.Handshake())
+	t1.LoopAsync()
+	select {
+	case p := <-received:
+		assert(string(p) == "hello")
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	n1, n2 := t1.Negotiated(), t2.Negotiated()
+	assert(n1.Version == 2 && n2.Version == 2)
+	assert(n1.Codec == "json" && n2.Codec == "json")
+	assert(n1.Compression == CompressFlate && n2.Compression == CompressFlate)
+	assert(n1.MaxFrameSize == 1024 && n2.MaxFrameSize == 1024)
+	assert(n1.PeerExtra["name"] == "t2")
+	t1.Close()
+
+	// incompatible peers are rejected on both sides
+	t1, t2 = pipe(HandshakeOptions{Version: 1}, HandshakeOptions{Version: 2, MinVersion: 2}, received)
+	t2.LoopAsync()
+	err := t1.Handshake()
+	assert(errors.Is(err, ErrHandshake))
+	<-t2.Context().Done()
+	assert(errors.Is(t2.Err(), ErrHandshake))
+
+	t1, t2 = pipe(HandshakeOptions{Codecs: []string{"json"}}, HandshakeOptions{Codecs: []string{"msgpack"}}, received)
+	t2.LoopAsync()
+	err = t1.Handshake()
+	assert(err.(*HandshakeError).Reason == "no common codec")
+}
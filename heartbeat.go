@@ -0,0 +1,82 @@
+package gotransport
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+var ErrIdleTimeout = errors.New("transport: idle timeout")
+
+func (t *transport) heartbeatTimeout() time.Duration {
+	h := t.opts.Heartbeat
+	if h == nil {
+		return 0
+	}
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return 3 * h.Interval
+}
+
+func (t *transport) heartbeatLoop() {
+	ticker := time.NewTicker(t.opts.Heartbeat.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if packet := t.heartbeatPacket(ControlPing); packet != nil {
+				t.enqueue(t.ctx, packet)
+			}
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// heartbeatPacket makes a ping or pong packet, nil if the protocol
+// can't carry heartbeats.
+func (t *transport) heartbeatPacket(kind byte) Protocol {
+	packet := t.ProtocolMake()
+	if cp, ok := packet.(ControlProtocol); ok {
+		cp.SetControl(kind)
+		return packet
+	}
+	payload := t.opts.Heartbeat.Ping
+	if kind == ControlPong {
+		payload = t.opts.Heartbeat.Pong
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	packet.SetPayload(payload)
+	return packet
+}
+
+// handleHeartbeat answers the ping, it reports whether the packet
+// was a heartbeat and is consumed.
+func (t *transport) handleHeartbeat(packet Protocol) bool {
+	h := t.opts.Heartbeat
+	if h == nil {
+		return false
+	}
+	var kind byte
+	if cp, ok := packet.(ControlProtocol); ok {
+		if kind, ok = cp.Control(); !ok || (kind != ControlPing && kind != ControlPong) {
+			return false
+		}
+	} else if len(h.Ping) > 0 && bytes.Equal(packet.Payload(), h.Ping) {
+		kind = ControlPing
+	} else if len(h.Pong) > 0 && bytes.Equal(packet.Payload(), h.Pong) {
+		kind = ControlPong
+	} else {
+		return false
+	}
+
+	if kind == ControlPing {
+		if pong := t.heartbeatPacket(ControlPong); pong != nil {
+			t.enqueue(t.ctx, pong)
+		}
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+package gotransport
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	opts := MakeOptions()
+	WithHeartbeat(HeartbeatOptions{Interval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond})(opts)
+	WithMessage(func(transport Transport, packet Protocol) {
+		t.Error("heartbeat delivered to OnMessage")
+	})(opts)
+
+	c1, c2 := net.Pipe()
+	t1 := NewTransport(context.Background(), c1, opts).LoopAsync()
+	t2 := NewTransport(context.Background(), c2, opts).LoopAsync()
+	time.Sleep(200 * time.Millisecond)
+	assert(!t1.IsClosed() && !t2.IsClosed())
+	t1.Close()
+	t2.Close()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	opts := MakeOptions()
+	WithHeartbeat(HeartbeatOptions{Timeout: 50 * time.Millisecond})(opts)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	t1 := NewTransport(context.Background(), c1, opts).LoopAsync()
+	select {
+	case err := <-t1.Done():
+		assert(err == ErrIdleTimeout)
+	case <-time.After(time.Second):
+		t.Fatal("idle transport not closed")
+	}
+}
@@ -0,0 +1,50 @@
+package gotransport
+
+import (
+	"errors"
+)
+
+var (
+	ErrNoMessageCodec = errors.New("transport: message codec not set")
+	ErrUnknownMessage = errors.New("transport: unknown message type")
+)
+
+// MessageCodec maps Go values to packets, e.g. router.Registry.
+type MessageCodec interface {
+	// Marshal encodes the message into the packet.
+	Marshal(msg interface{}, packet Protocol) error
+	// Unmarshal decodes the packet, it returns ErrUnknownMessage
+	// if the packet is not a registered message.
+	Unmarshal(packet Protocol) (interface{}, error)
+}
+
+func (t *transport) Send(msg interface{}) error {
+	if t.opts.MessageCodec == nil {
+		return ErrNoMessageCodec
+	}
+	packet := t.ProtocolMake()
+	if err := t.opts.MessageCodec.Marshal(msg, packet); err != nil {
+		return err
+	}
+	_, err := t.WritePacket(packet)
+	return err
+}
+
+// typedMessageHandler decodes the packets for the typed handler, the
+// unknown ones are passed to the fallback handler, which may be nil.
+// A packet failed to decode closes the transport.
+func typedMessageHandler(c MessageCodec, typed TypedMessageHandler, fallback MessageHandler) MessageHandler {
+	return func(transport Transport, packet Protocol) {
+		msg, err := c.Unmarshal(packet)
+		switch {
+		case err == nil:
+			typed(transport, msg)
+		case err == ErrUnknownMessage:
+			if fallback != nil {
+				fallback(transport, packet)
+			}
+		default:
+			transport.CloseWithError(err)
+		}
+	}
+}
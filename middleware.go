@@ -0,0 +1,46 @@
+package gotransport
+
+import (
+	"log"
+	"time"
+)
+
+// Middleware wraps a message handler, e.g. for logging, auth or metrics.
+type Middleware func(next MessageHandler) MessageHandler
+
+// WriteInterceptor wraps the outbound path of WritePacket.
+type WriteInterceptor func(next WriteHandler) WriteHandler
+
+// Recovery recovers the panic of the message handler, and closes the
+// transport with the panic as the reason. MakeOptions installs it as
+// the outermost middleware, it may be replaced to log or handle the
+// panic otherwise, the transport recovers the panics left anyway.
+func Recovery() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(transport Transport, packet Protocol) {
+			defer func() {
+				if err := recover(); err != nil {
+					transport.CloseWithError(errorWrap(err))
+				}
+			}()
+			next(transport, packet)
+		}
+	}
+}
+
+// Logging logs every message with its handling time, the standard
+// logger is used if logger is nil.
+func Logging(logger *log.Logger) Middleware {
+	printf := log.Printf
+	if logger != nil {
+		printf = logger.Printf
+	}
+	return func(next MessageHandler) MessageHandler {
+		return func(transport Transport, packet Protocol) {
+			start := time.Now()
+			next(transport, packet)
+			printf("transport %d %v: message %d bytes, handled in %v",
+				transport.ID(), transport.Peer(), len(packet.Payload()), time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Channel is a logical connection of a Session, it implements net.Conn,
+// so a gotransport.Transport can run over it as well.
+type Channel struct {
+	s  *Session
+	id uint64
+
+	writeMu sync.Mutex // keeps the frames of a Write together
+
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	recvWindow int // bytes the peer may still send
+	consumed   int // bytes read but not granted yet
+	sendWindow int // bytes we may still send
+	readErr    error
+	writeErr   error
+	closed     bool
+	readable   chan struct{}
+	writable   chan struct{}
+	rDeadline  deadline
+	wDeadline  deadline
+}
+
+func newChannel(s *Session, id uint64, sendWindow int) *Channel {
+	return &Channel{
+		s:          s,
+		id:         id,
+		recvWindow: s.config.Window,
+		sendWindow: sendWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		rDeadline:  makeDeadline(),
+		wDeadline:  makeDeadline(),
+	}
+}
+
+// ID returns the channel id, which is unique in the session.
+func (c *Channel) ID() uint64 {
+	return c.id
+}
+
+func (c *Channel) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, ErrChannelClosed
+		}
+		if c.buf.Len() > 0 {
+			n, _ := c.buf.Read(p)
+			c.consumed += n
+			// grant the window back once half of it is consumed
+			var grant int
+			if c.consumed >= c.s.config.Window/2 && c.readErr == nil {
+				grant, c.consumed = c.consumed, 0
+				c.recvWindow += grant
+			}
+			c.mu.Unlock()
+			if grant > 0 {
+				var buf [binary.MaxVarintLen64]byte
+				c.s.send(frameWindow, c.id, buf[:binary.PutUvarint(buf[:], uint64(grant))])
+			}
+			return n, nil
+		}
+		if err := c.readErr; err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		c.mu.Unlock()
+		if len(p) == 0 {
+			return 0, nil
+		}
+
+		select {
+		case <-c.readable:
+		case <-c.rDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *Channel) Write(p []byte) (n int, err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	for len(p) > 0 {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return n, ErrChannelClosed
+		}
+		if err := c.writeErr; err != nil {
+			c.mu.Unlock()
+			return n, err
+		}
+		if c.sendWindow == 0 {
+			c.mu.Unlock()
+			select {
+			case <-c.writable:
+			case <-c.wDeadline.wait():
+				return n, os.ErrDeadlineExceeded
+			}
+			continue
+		}
+		size := len(p)
+		if size > c.sendWindow {
+			size = c.sendWindow
+		}
+		if size > c.s.config.MaxFrameSize {
+			size = c.s.config.MaxFrameSize
+		}
+		c.sendWindow -= size
+		c.mu.Unlock()
+
+		if err := c.s.send(frameData, c.id, p[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// CloseWrite tells the peer no more data is written, the peer reads io.EOF.
+func (c *Channel) CloseWrite() error {
+	c.mu.Lock()
+	if c.closed || c.writeErr != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.writeErr = ErrChannelClosed
+	c.mu.Unlock()
+	return c.s.send(frameClose, c.id, nil)
+}
+
+// Close closes the channel, the peer reads io.EOF after the data sent.
+// If the peer may still write, it is reset too, so its writes fail with
+// ErrChannelReset rather than waiting for a window never granted.
+func (c *Channel) Close() error {
+	err := c.CloseWrite()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	reading := c.readErr == nil
+	c.mu.Unlock()
+	c.s.remove(c.id)
+	if reading {
+		if rerr := c.s.send(frameReset, c.id, nil); err == nil {
+			err = rerr
+		}
+	}
+	notify(c.readable)
+	notify(c.writable)
+	return err
+}
+
+func (c *Channel) LocalAddr() net.Addr {
+	return c.s.t.Host()
+}
+
+func (c *Channel) RemoteAddr() net.Addr {
+	return c.s.t.Peer()
+}
+
+func (c *Channel) SetDeadline(t time.Time) error {
+	c.rDeadline.set(t)
+	c.wDeadline.set(t)
+	return nil
+}
+
+func (c *Channel) SetReadDeadline(t time.Time) error {
+	c.rDeadline.set(t)
+	return nil
+}
+
+func (c *Channel) SetWriteDeadline(t time.Time) error {
+	c.wDeadline.set(t)
+	return nil
+}
+
+// received buffers the data from the peer within the window.
+func (c *Channel) received(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(data) > c.recvWindow {
+		return ErrWindowExceeded
+	}
+	c.recvWindow -= len(data)
+	if !c.closed && c.readErr == nil {
+		c.buf.Write(data)
+		notify(c.readable)
+	}
+	return nil
+}
+
+// granted adds the window increment given by the peer.
+func (c *Channel) granted(increment int) {
+	c.mu.Lock()
+	c.sendWindow += increment
+	c.mu.Unlock()
+	notify(c.writable)
+}
+
+// abortRead stops the reading after the data buffered,
+// with io.EOF if err is nil.
+func (c *Channel) abortRead(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	c.mu.Lock()
+	if c.readErr == nil {
+		c.readErr = err
+	}
+	c.mu.Unlock()
+	notify(c.readable)
+}
+
+// abort stops the reading and writing with err.
+func (c *Channel) abort(err error) {
+	c.abortRead(err)
+	c.mu.Lock()
+	if c.writeErr == nil || c.writeErr == ErrChannelClosed {
+		c.writeErr = err
+	}
+	c.mu.Unlock()
+	notify(c.writable)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// deadline is a channel closed when the deadline passes, as net.Pipe does.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,152 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/luweimy/gotransport"
+)
+
+// pipe returns the sessions of two connected transports.
+func pipe(config *Config) (*Session, *Session) {
+	sessions := make(chan *Session, 2)
+	opts := gotransport.MakeOptions()
+	gotransport.WithConnected(func(t gotransport.Transport) bool {
+		sessions <- NewSession(t, config)
+		return true
+	})(opts)
+	gotransport.WithMessage(OnMessage)(opts)
+
+	c1, c2 := net.Pipe()
+	gotransport.NewTransport(context.Background(), c1, opts).LoopAsync()
+	gotransport.NewTransport(context.Background(), c2, opts).LoopAsync()
+	return <-sessions, <-sessions
+}
+
+func TestChannel(t *testing.T) {
+	s1, s2 := pipe(&Config{Window: 4096, MaxFrameSize: 1024})
+	defer s1.Close()
+
+	// more data than the window, in both directions at once
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	echo := func(c *Channel) {
+		io.Copy(c, c)
+		c.Close()
+	}
+	go func() {
+		for {
+			c, err := s2.AcceptChannel()
+			if err != nil {
+				return
+			}
+			go echo(c)
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		c, err := s1.OpenChannel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			c.Write(data)
+			c.CloseWrite()
+		}()
+		got, err := ioutil.ReadAll(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("channel %d: echoed %d bytes, want %d", c.ID(), len(got), len(data))
+		}
+		c.Close()
+	}
+
+	// read deadline
+	c, _ := s2.OpenChannel()
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 1)); err != os.ErrDeadlineExceeded {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+
+	// the session closes with the transport
+	c.SetReadDeadline(time.Time{})
+	s2.Transport().Close()
+	if _, err := c.Read(make([]byte, 1)); err != ErrSessionClosed {
+		t.Fatalf("err = %v, want %v", err, ErrSessionClosed)
+	}
+}
+
+func TestCloseReset(t *testing.T) {
+	s1, s2 := pipe(&Config{Window: 4096, MaxFrameSize: 1024})
+	defer s1.Close()
+	go func() {
+		// closed without reading
+		c, err := s2.AcceptChannel()
+		if err == nil {
+			c.Close()
+		}
+	}()
+
+	c, err := s1.OpenChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Write(make([]byte, 64*1024))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrChannelReset {
+			t.Fatalf("err = %v, want %v", err, ErrChannelReset)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write blocked after the peer closed")
+	}
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read %v, want io.EOF", err)
+	}
+}
+
+func TestTransportOverChannel(t *testing.T) {
+	s1, s2 := pipe(nil)
+	defer s1.Close()
+
+	received := make(chan string, 1)
+	opts := gotransport.MakeOptions()
+	gotransport.WithMessage(func(t gotransport.Transport, packet gotransport.Protocol) {
+		received <- string(packet.Payload())
+	})(opts)
+
+	c1, err := s1.OpenChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := s2.AcceptChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1 := gotransport.NewTransport(context.Background(), c1, nil)
+	defer t1.Close()
+	gotransport.NewTransport(context.Background(), c2, opts).LoopAsync()
+	t1.WriteString("hello")
+
+	select {
+	case s := <-received:
+		if s != "hello" {
+			t.Fatalf("received %q", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+}
@@ -0,0 +1,260 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/luweimy/gotransport"
+)
+
+var (
+	ErrSessionClosed  = errors.New("mux: session closed")
+	ErrChannelClosed  = errors.New("mux: channel closed")
+	ErrChannelReset   = errors.New("mux: channel reset by peer")
+	ErrMalformed      = errors.New("mux: malformed frame")
+	ErrWindowExceeded = errors.New("mux: peer exceeded the window")
+)
+
+const (
+	DefaultWindow        = 256 * 1024
+	DefaultMaxFrameSize  = 32 * 1024
+	DefaultAcceptBacklog = 128
+)
+
+// frame kinds
+const (
+	frameOpen   byte = iota // data is the window of the opener
+	frameData               // data is the channel data
+	frameWindow             // data is the window increment
+	frameClose              // the sender won't write any more
+	frameReset              // the channel is aborted
+)
+
+// sessionKey is the session data key of the Session of a transport.
+const sessionKey = "gotransport.mux"
+
+// Config configures a Session, the zero value uses the defaults.
+type Config struct {
+	Window        int // receive window of a channel, default DefaultWindow
+	MaxFrameSize  int // max data size of a frame, default DefaultMaxFrameSize
+	AcceptBacklog int // channels opened by the peer waiting to be accepted, default DefaultAcceptBacklog
+}
+
+// Session multiplexes channels over a transport, each packet carries
+//
+//  [ kind (1) ][ channel id (uvarint) ][ data ]
+//
+// The lowest bit of the channel id tells if the sender opened it, so both
+// peers open channels without picking roles. A channel is only sent as
+// much data as its receiver granted, so the receiver never blocks the
+// transport.
+//
+// The transport is dedicated to the session, its OnMessage must be
+// OnMessage of this package, with DispatchInline or DispatchOrdered as the
+// frames must be handled in order.
+type Session struct {
+	t      gotransport.Transport
+	config Config
+
+	mu       sync.Mutex
+	nextID   uint64
+	channels map[uint64]*Channel
+	accept   chan *Channel
+	closed   chan struct{}
+	err      error
+	once     sync.Once
+}
+
+// NewSession makes the session of the transport, it should be called
+// before the transport reads, e.g. in OnConnected.
+func NewSession(t gotransport.Transport, config *Config) *Session {
+	s := &Session{
+		t:        t,
+		channels: make(map[uint64]*Channel),
+		closed:   make(chan struct{}),
+	}
+	if config != nil {
+		s.config = *config
+	}
+	if s.config.Window <= 0 {
+		s.config.Window = DefaultWindow
+	}
+	if s.config.MaxFrameSize <= 0 {
+		s.config.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if s.config.AcceptBacklog <= 0 {
+		s.config.AcceptBacklog = DefaultAcceptBacklog
+	}
+	s.accept = make(chan *Channel, s.config.AcceptBacklog)
+	t.Set(sessionKey, s)
+	go func() {
+		<-t.Context().Done()
+		s.shutdown(ErrSessionClosed)
+	}()
+	return s
+}
+
+// OnMessage is a gotransport.MessageHandler, install it with gotransport.WithMessage.
+// A malformed frame or a peer exceeding the window closes the transport.
+func OnMessage(transport gotransport.Transport, packet gotransport.Protocol) {
+	v, ok := transport.Get(sessionKey)
+	if !ok {
+		return
+	}
+	if err := v.(*Session).handle(packet.Payload()); err != nil {
+		transport.CloseWithError(err)
+	}
+}
+
+// Transport returns the transport of the session.
+func (s *Session) Transport() gotransport.Transport {
+	return s.t
+}
+
+// OpenChannel opens a channel to the peer, it doesn't wait for the peer
+// to accept it, but the writes wait for the window granted.
+func (s *Session) OpenChannel() (*Channel, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	s.nextID++
+	c := newChannel(s, s.nextID<<1|1, 0)
+	s.channels[c.id] = c
+	s.mu.Unlock()
+
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(s.config.Window))
+	if err := s.send(frameOpen, c.id, buf[:n]); err != nil {
+		s.remove(c.id)
+		return nil, err
+	}
+	return c, nil
+}
+
+// AcceptChannel waits for a channel opened by the peer.
+func (s *Session) AcceptChannel() (*Channel, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, s.err
+	}
+}
+
+// Close closes the channels and the transport.
+func (s *Session) Close() error {
+	s.shutdown(ErrSessionClosed)
+	return s.t.Close()
+}
+
+func (s *Session) shutdown(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		channels := s.channels
+		s.channels = make(map[uint64]*Channel)
+		s.mu.Unlock()
+		close(s.closed)
+		for _, c := range channels {
+			c.abort(err)
+		}
+	})
+}
+
+func (s *Session) remove(id uint64) {
+	s.mu.Lock()
+	delete(s.channels, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) channel(id uint64) *Channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.channels[id]
+}
+
+// send writes a frame, the id is seen by the receiver with the lowest bit flipped.
+func (s *Session) send(kind byte, id uint64, data []byte) error {
+	var buf [1 + binary.MaxVarintLen64]byte
+	buf[0] = kind
+	n := 1 + binary.PutUvarint(buf[1:], id)
+	payload := make([]byte, 0, n+len(data))
+	payload = append(payload, buf[:n]...)
+	payload = append(payload, data...)
+
+	packet := s.t.ProtocolMake()
+	packet.SetPayload(payload)
+	_, err := s.t.WritePacket(packet)
+	return err
+}
+
+func (s *Session) handle(payload []byte) error {
+	if len(payload) < 2 {
+		return ErrMalformed
+	}
+	kind := payload[0]
+	id, n := binary.Uvarint(payload[1:])
+	if n <= 0 {
+		return ErrMalformed
+	}
+	id ^= 1
+	data := payload[1+n:]
+
+	if kind == frameOpen {
+		window, n := binary.Uvarint(data)
+		if n <= 0 || id&1 == 1 {
+			return ErrMalformed
+		}
+		return s.opened(id, int(window))
+	}
+
+	c := s.channel(id)
+	if c == nil {
+		// closed here already
+		return nil
+	}
+	switch kind {
+	case frameData:
+		return c.received(data)
+	case frameWindow:
+		increment, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrMalformed
+		}
+		c.granted(int(increment))
+	case frameClose:
+		c.abortRead(nil)
+	case frameReset:
+		s.remove(id)
+		c.abort(ErrChannelReset)
+	default:
+		return ErrMalformed
+	}
+	return nil
+}
+
+// opened accepts the channel opened by the peer, or resets it if the
+// backlog is full.
+func (s *Session) opened(id uint64, window int) error {
+	s.mu.Lock()
+	if s.err != nil || s.channels[id] != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	c := newChannel(s, id, window)
+	s.channels[id] = c
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- c:
+		var buf [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(buf[:], uint64(s.config.Window))
+		return s.send(frameWindow, id, buf[:n])
+	default:
+		s.remove(id)
+		return s.send(frameReset, id, nil)
+	}
+}
@@ -2,13 +2,79 @@ package gotransport
 
 import (
 	"crypto/tls"
+	"io"
 	"net"
+	"time"
 )
 
 type ConnectHandler func(transport Transport) bool
 type MessageHandler func(transport Transport, packet Protocol)
+type TypedMessageHandler func(transport Transport, msg interface{})
 type CloseHandler func(transport Transport, err error)
 type HookHandler func(conn net.Conn) net.Conn
+type WriteHandler func(transport Transport, packet Protocol) (n int, err error)
+type StreamHandler func(transport Transport, stream io.Reader)
+type ReconnectHandler func(transport Transport, attempt int, err error)
+
+// ReconnectOptions configures the client reconnect mode.
+type ReconnectOptions struct {
+	MaxAttempts int           // give up after MaxAttempts failed dials, 0 means never give up
+	MinDelay    time.Duration // delay before the first attempt, doubled on each attempt
+	MaxDelay    time.Duration // upper bound of the delay
+	Jitter      float64       // randomize the delay by ±Jitter (0.0-1.0)
+	QueueSize   int           // writes queued while disconnected, 0 means fail fast
+}
+
+// HeartbeatOptions configures the application-level heartbeat.
+//
+// Protocols implementing ControlProtocol carry ping/pong as control frames,
+// for other protocols the Ping/Pong payloads are used instead, if they are
+// empty no ping is sent and only the idle timeout is checked.
+type HeartbeatOptions struct {
+	Interval time.Duration // send a ping every Interval, 0 means never ping
+	Timeout  time.Duration // close with ErrIdleTimeout when nothing arrives within Timeout, default 3*Interval
+	Ping     []byte
+	Pong     []byte
+}
+
+// HandshakeOptions configures the handshake, in which the peers exchange
+// their hellos on the raw conn, see Negotiation. Both peers must have it.
+type HandshakeOptions struct {
+	Version      uint16
+	MinVersion   uint16        // oldest version accepted, 0 means any
+	Codecs       []string      // names of the supported codecs, in order of preference
+	Compressions []Compression // supported compressions, in order of preference
+	MaxFrameSize int           // max frame size accepted, default MaxPacketSize
+	Extra        map[string]string
+	Timeout      time.Duration // max time of the handshake, default 10s
+}
+
+// FlowUnit is the unit of the credits.
+type FlowUnit int
+
+const (
+	FlowMessages FlowUnit = iota // a credit per packet
+	FlowBytes                    // a credit per payload byte
+)
+
+// FlowControlOptions configures the credit-based flow control. The peer
+// may send Window credits of packets not handled yet, the credits are
+// granted back with control frames as the handlers return. Both peers
+// must have it, and the protocol must implement ControlProtocol.
+type FlowControlOptions struct {
+	Window      int // credits granted to the peer
+	Unit        FlowUnit
+	NonBlocking bool // writes fail with ErrWouldBlock instead of waiting for credits
+}
+
+// QueuePolicy decides what a write does when the send queue is full.
+type QueuePolicy int
+
+const (
+	QueueBlock QueuePolicy = iota // wait for room in the queue
+	QueueDrop                     // drop the packet, the write fails with ErrQueueFull
+	QueueClose                    // close the transport with ErrQueueFull
+)
 
 type Options struct {
 	OnConnected ConnectHandler
@@ -19,11 +85,49 @@ type Options struct {
 	BufferSize  int // size of transport reader buffer
 	Hooks       []HookHandler
 	ConfigTLS   *tls.Config
+
+	MaxPacketSize int // max frame size of protocols implementing SizeLimiter, default MaxPacketSize
+
+	Reconnect      *ReconnectOptions
+	OnReconnecting ReconnectHandler
+	OnReconnected  ReconnectHandler
+
+	Heartbeat *HeartbeatOptions
+
+	Handshake *HandshakeOptions
+
+	Authenticator Authenticator
+	AuthTimeout   time.Duration // max time of the authentication, default 10s
+
+	ReadTimeout  time.Duration // max time to read a frame once it begins to arrive
+	WriteTimeout time.Duration // max time to write a frame
+	IdleTimeout  time.Duration // max time to wait for the next frame, see ErrIdleTimeout
+
+	MaxPeers int // max remote addresses served by a datagram server at once
+
+	SendQueueSize   int // size of transport send queue, default SendQueueSize
+	SendQueuePolicy QueuePolicy
+
+	DispatchMode      DispatchMode
+	DispatchQueueSize int         // size of the per-transport queue of DispatchOrdered
+	Pool              *WorkerPool // workers of DispatchPool, default DefaultPool()
+
+	Middlewares       []Middleware
+	WriteInterceptors []WriteInterceptor
+
+	MessageCodec   MessageCodec
+	OnTypedMessage TypedMessageHandler
+
+	OnStream   StreamHandler
+	MaxStreams int // max streams handled at once, the ones beyond are reset, default MaxStreams
+
+	FlowControl *FlowControlOptions
 }
 
 func MakeOptions() *Options {
 	return &Options{
-		Factory: PacketProtocol,
+		Factory:     PacketProtocol,
+		Middlewares: []Middleware{Recovery()},
 	}
 }
 
@@ -68,6 +172,52 @@ func WithBufferSize(bufferSize int) OptionFunc {
 	}
 }
 
+// 握手阶段在OnConnected之前协商版本、编解码、压缩和最大帧大小
+// 不兼容时连接以HandshakeError关闭
+func WithHandshake(handshake HandshakeOptions) OptionFunc {
+	return func(o *Options) {
+		o.Handshake = &handshake
+	}
+}
+
+// 接收对端OpenStream打开的流，每个流在单独的goroutine中回调
+// 回调不读取时会阻塞连接的读取
+func WithStream(cb StreamHandler) OptionFunc {
+	return func(o *Options) {
+		o.OnStream = cb
+	}
+}
+
+// 同时处理的最大流数量，超过后新打开的流被重置，不回调OnStream
+func WithMaxStreams(n int) OptionFunc {
+	return func(o *Options) {
+		o.MaxStreams = n
+	}
+}
+
+// 开启基于信用的流量控制，对端未处理的消息超出窗口时写入阻塞或返回ErrWouldBlock
+func WithFlowControl(flow FlowControlOptions) OptionFunc {
+	return func(o *Options) {
+		o.FlowControl = &flow
+	}
+}
+
+// 在OnConnected之前用最初的数据帧认证对端，timeout为0时默认10秒
+// 认证失败时连接以该错误关闭
+func WithAuth(auth Authenticator, timeout time.Duration) OptionFunc {
+	return func(o *Options) {
+		o.Authenticator = auth
+		o.AuthTimeout = timeout
+	}
+}
+
+// 设置最大数据帧大小，超出则以*PacketSizeError关闭连接
+func WithMaxPacketSize(size int) OptionFunc {
+	return func(o *Options) {
+		o.MaxPacketSize = size
+	}
+}
+
 func WithHook(hook HookHandler) OptionFunc {
 	return func(o *Options) {
 		o.Hooks = append(o.Hooks, hook)
@@ -79,3 +229,112 @@ func WithTLS(tlsConfig *tls.Config) OptionFunc {
 		o.ConfigTLS = tlsConfig
 	}
 }
+
+// 开启客户端断线重连
+func WithReconnect(reconnect ReconnectOptions) OptionFunc {
+	return func(o *Options) {
+		o.Reconnect = &reconnect
+	}
+}
+
+// 每次重连尝试之前回调，err为上一次断开或拨号失败的原因
+func WithReconnecting(cb ReconnectHandler) OptionFunc {
+	return func(o *Options) {
+		o.OnReconnecting = cb
+	}
+}
+
+// 重连成功后回调，transport为新建立的连接，err为断开的原因
+func WithReconnected(cb ReconnectHandler) OptionFunc {
+	return func(o *Options) {
+		o.OnReconnected = cb
+	}
+}
+
+// 开启心跳检测，超时未收到任何数据则以ErrIdleTimeout关闭连接
+func WithHeartbeat(heartbeat HeartbeatOptions) OptionFunc {
+	return func(o *Options) {
+		o.Heartbeat = &heartbeat
+	}
+}
+
+// 读取一个完整数据帧的超时时间（从数据帧开始到达时计时）
+func WithReadTimeout(timeout time.Duration) OptionFunc {
+	return func(o *Options) {
+		o.ReadTimeout = timeout
+	}
+}
+
+// 写入一个完整数据帧的超时时间
+func WithWriteTimeout(timeout time.Duration) OptionFunc {
+	return func(o *Options) {
+		o.WriteTimeout = timeout
+	}
+}
+
+// 等待下一个数据帧的超时时间，超时则以ErrIdleTimeout关闭连接
+func WithIdleTimeout(timeout time.Duration) OptionFunc {
+	return func(o *Options) {
+		o.IdleTimeout = timeout
+	}
+}
+
+// 数据报服务端同时服务的最大对端地址数，超过后新地址的数据报被丢弃
+func WithMaxPeers(n int) OptionFunc {
+	return func(o *Options) {
+		o.MaxPeers = n
+	}
+}
+
+// 设置发送队列大小，以及队列满时的处理策略
+func WithSendQueue(size int, policy QueuePolicy) OptionFunc {
+	return func(o *Options) {
+		o.SendQueueSize = size
+		o.SendQueuePolicy = policy
+	}
+}
+
+// 设置消息分发模式，DispatchOrdered模式下queueSize为每个连接的消息队列大小
+// 队列满时暂停读取数据，DispatchPool模式未设置协程池时使用DefaultPool
+func WithDispatch(mode DispatchMode, queueSize int) OptionFunc {
+	return func(o *Options) {
+		o.DispatchMode = mode
+		o.DispatchQueueSize = queueSize
+	}
+}
+
+// 使用共享的协程池处理消息，可限制所有连接的消息处理并发数
+func WithWorkerPool(pool *WorkerPool) OptionFunc {
+	return func(o *Options) {
+		o.DispatchMode = DispatchPool
+		o.Pool = pool
+	}
+}
+
+// 添加消息处理中间件，先添加的在外层
+func WithMiddleware(mw ...Middleware) OptionFunc {
+	return func(o *Options) {
+		o.Middlewares = append(o.Middlewares, mw...)
+	}
+}
+
+// 添加写数据拦截器，先添加的在外层
+func WithWriteInterceptor(interceptors ...WriteInterceptor) OptionFunc {
+	return func(o *Options) {
+		o.WriteInterceptors = append(o.WriteInterceptors, interceptors...)
+	}
+}
+
+// 设置消息编解码器，用于Transport.Send和OnTypedMessage
+func WithMessageCodec(c MessageCodec) OptionFunc {
+	return func(o *Options) {
+		o.MessageCodec = c
+	}
+}
+
+// 接收解码后的消息，未注册类型的数据包仍然交给OnMessage处理
+func WithTypedMessage(cb TypedMessageHandler) OptionFunc {
+	return func(o *Options) {
+		o.OnTypedMessage = cb
+	}
+}
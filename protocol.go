@@ -1,7 +1,9 @@
 package gotransport
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -12,6 +14,23 @@ var (
 
 type ProtocolFactory func() Protocol
 
+// Control frame kinds used by the transport.
+const (
+	ControlPing   byte = 0xFF
+	ControlPong   byte = 0xFE
+	ControlStream byte = 0xFD
+	ControlCredit byte = 0xFC
+)
+
+// ControlProtocol is implemented by protocols that can mark a frame as a
+// control frame, which is consumed by the transport instead of OnMessage.
+// The control frames are only interpreted when the feature using them is
+// enabled, otherwise they are delivered as normal packets.
+type ControlProtocol interface {
+	SetControl(kind byte)
+	Control() (kind byte, ok bool)
+}
+
 type Protocol interface {
 	// 最终写入的长度就是返回值n
 	WriteTo(w io.Writer) (n int, err error)
@@ -31,6 +50,67 @@ type Protocol interface {
 	FlagOptions() Value
 }
 
+// SizeLimiter is implemented by protocols that limit the frame size,
+// the transport sets the limit of Options.MaxPacketSize on the packets
+// it makes, see Transport.ProtocolMake.
+type SizeLimiter interface {
+	SetMaxSize(size int)
+}
+
+// TransportBinder is implemented by protocols that keep per-transport
+// state, such as the counters of SealProtocol. The transport binds the
+// packets it makes and the packets written to it.
+type TransportBinder interface {
+	BindTransport(t Transport)
+}
+
+// PacketSizeError reports a frame larger than the max packet size,
+// it matches ErrTooLarge with errors.Is.
+type PacketSizeError struct {
+	Size  int64
+	Limit int
+}
+
+func (e *PacketSizeError) Error() string {
+	return fmt.Sprintf("packet: size %d exceeds the limit %d", e.Size, e.Limit)
+}
+
+func (e *PacketSizeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+// sizeLimit returns the limit, MaxPacketSize if not set.
+func sizeLimit(limit int) int {
+	if limit > 0 {
+		return limit
+	}
+	return MaxPacketSize
+}
+
+// Encode encodes the packet once, the returned protocol writes the same
+// bytes on every WriteTo, so one packet can be fanned out to many
+// transports without encoding it again. It is meant for writing only.
+// A TransportBinder packet is encoded per transport, so it is returned as is.
+func Encode(packet Protocol) (Protocol, error) {
+	if _, ok := packet.(TransportBinder); ok {
+		return packet, nil
+	}
+	buf := &bytes.Buffer{}
+	if _, err := packet.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return &encodedProtocol{Protocol: packet, data: buf.Bytes()}, nil
+}
+
+type encodedProtocol struct {
+	Protocol
+	data []byte
+}
+
+func (p *encodedProtocol) WriteTo(w io.Writer) (int, error) {
+	return w.Write(p.data)
+}
+
 type Value interface {
 	Byte() byte
 	Bytes() []byte
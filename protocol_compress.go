@@ -0,0 +1,150 @@
+package gotransport
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var ErrBadCompression = errors.New("compress: bad compressed payload")
+
+// Compression is the algorithm flag in front of the compressed payload.
+type Compression byte
+
+const (
+	CompressNone Compression = iota
+	CompressGzip
+	CompressZlib
+	CompressFlate
+)
+
+// CompressProtocol wraps the inner protocol, the payloads of at least
+// minSize bytes are compressed with algo.
+//
+// A one-byte flag in front of the inner payload tells the algorithm,
+// so peers may mix compressed and plain packets, and any algorithm
+// above can be read regardless of algo. A payload that doesn't get
+// smaller is sent plain.
+//
+// Over a protocol framing by delimiter, such as LineProtocol, the flag
+// and payload are carried base64 encoded, as the compressed bytes may
+// contain the delimiter, which must not be a base64 character then.
+func CompressProtocol(inner ProtocolFactory, algo Compression, minSize int) ProtocolFactory {
+	c := &compressor{algo: algo, minSize: minSize}
+	return func() Protocol {
+		return wrap(inner(), c)
+	}
+}
+
+type compressor struct {
+	algo    Compression
+	minSize int
+}
+
+func (c *compressor) encode(inner Protocol, payload []byte) ([]byte, error) {
+	data, err := c.compress(payload)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := inner.(*lineProtocol); ok {
+		encoded := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+		base64.StdEncoding.Encode(encoded, data)
+		return encoded, nil
+	}
+	return data, nil
+}
+
+func (c *compressor) compress(payload []byte) ([]byte, error) {
+	if c.algo != CompressNone && len(payload) >= c.minSize {
+		buf := &bytes.Buffer{}
+		buf.WriteByte(byte(c.algo))
+		w, err := newCompressWriter(c.algo, buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		if buf.Len() < len(payload)+1 {
+			return buf.Bytes(), nil
+		}
+	}
+	data := make([]byte, len(payload)+1)
+	data[0] = byte(CompressNone)
+	copy(data[1:], payload)
+	return data, nil
+}
+
+func (c *compressor) decode(inner Protocol, data []byte, maxSize int) ([]byte, error) {
+	if l, ok := inner.(*lineProtocol); ok {
+		data = l.trim(data)
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		n, err := base64.StdEncoding.Decode(decoded, data)
+		if err != nil {
+			return nil, ErrBadCompression
+		}
+		data = decoded[:n]
+	}
+	if len(data) == 0 {
+		return nil, ErrBadCompression
+	}
+	algo, data := Compression(data[0]), data[1:]
+	if algo == CompressNone {
+		return data, nil
+	}
+
+	r, err := newCompressReader(algo, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// limit the decompressed size, or a tiny frame could inflate to gigabytes
+	payload, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, ErrBadCompression
+	}
+	if len(payload) > maxSize {
+		return nil, &PacketSizeError{Size: int64(len(payload)), Limit: maxSize}
+	}
+	return payload, nil
+}
+
+func newCompressWriter(algo Compression, w io.Writer) (io.WriteCloser, error) {
+	switch algo {
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZlib:
+		return zlib.NewWriter(w), nil
+	case CompressFlate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	}
+	return nil, ErrBadCompression
+}
+
+func newCompressReader(algo Compression, r io.Reader) (io.ReadCloser, error) {
+	switch algo {
+	case CompressGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, ErrBadCompression
+		}
+		return zr, nil
+	case CompressZlib:
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, ErrBadCompression
+		}
+		return zr, nil
+	case CompressFlate:
+		return flate.NewReader(r), nil
+	}
+	return nil, ErrBadCompression
+}
@@ -0,0 +1,69 @@
+package gotransport
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	large := bytes.Repeat([]byte(`{"name":"gotransport"}`), 100)
+	for _, algo := range []Compression{CompressNone, CompressGzip, CompressZlib, CompressFlate} {
+		factory := CompressProtocol(PacketProtocol, algo, 64)
+		for _, payload := range [][]byte{[]byte("small"), large} {
+			p := factory()
+			assertErr(p.SetFlagOptions(byte(3)))
+			p.SetPayload(payload)
+			buf := &bytes.Buffer{}
+			n, err := p.WriteTo(buf)
+			assertErr(err)
+			if algo != CompressNone && len(payload) == len(large) {
+				assert(n < len(large)/10)
+			}
+
+			// any reader decodes any algorithm
+			p2 := CompressProtocol(PacketProtocol, CompressNone, 0)()
+			_, err = p2.ReadFrom(buf)
+			assertErr(err)
+			assert(bytes.Equal(p2.Payload(), payload))
+			assert(p2.FlagOptions().Byte() == 3)
+		}
+	}
+
+	// the decompressed size is limited
+	p := CompressProtocol(PacketProtocol, CompressGzip, 0)()
+	p.SetPayload(large)
+	buf := &bytes.Buffer{}
+	_, err := p.WriteTo(buf)
+	assertErr(err)
+	p2 := CompressProtocol(PacketProtocol, CompressNone, 0)()
+	p2.(SizeLimiter).SetMaxSize(1024)
+	_, err = p2.ReadFrom(buf)
+	_, ok := err.(*PacketSizeError)
+	assert(ok)
+	_, ok = p2.(ControlProtocol)
+	assert(ok)
+
+	// the compressed bytes may contain the delimiter
+	for _, inner := range []ProtocolFactory{LineProtocol, DelimiterProtocol([]byte{0}, true)} {
+		factory := CompressProtocol(inner, CompressGzip, 0)
+		buf := &bytes.Buffer{}
+		payloads := make([][]byte, 200)
+		for i := range payloads {
+			payloads[i] = []byte(strings.Repeat(strconv.Itoa(i), 20+i))
+			p := factory()
+			p.SetPayload(payloads[i])
+			_, err := p.WriteTo(buf)
+			assertErr(err)
+		}
+		reader := bufio.NewReader(buf)
+		for _, payload := range payloads {
+			p := factory()
+			_, err := p.ReadFrom(reader)
+			assertErr(err)
+			assert(bytes.Equal(p.Payload(), payload))
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package gotransport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+var ErrBadLength = errors.New("lengthfield: bad frame length")
+
+// VarintWidth makes the length field an unsigned varint, see encoding/binary.
+const VarintWidth = -1
+
+// LengthFieldConfig describes a frame with a length field, in the spirit of
+// Netty's LengthFieldBasedFrameDecoder.
+//
+//  [ header (Offset) ][ length (Width) ][ body (length + Adjustment) ]
+//  \---- Strip ----/ \--------------- payload -------------------/   (Strip = Offset)
+//
+// When the length counts the whole frame, set Adjustment to -(Offset+Width).
+type LengthFieldConfig struct {
+	Offset       int  // bytes before the length field
+	Width        int  // 1, 2, 3, 4, 8 or VarintWidth
+	LittleEndian bool // byte order of the fixed width length field
+	Adjustment   int  // added to the length field to get the size of the body
+	Strip        int  // bytes stripped from the frame start to get the payload
+}
+
+// lengthFieldProtocol
+// The header bytes before the length field are exposed by FlagOptions
+// as []byte. WriteTo writes header, length field and payload, so the
+// payload read back is equal to the written one when Strip is
+// Offset+Width, the Strip only applies to reading.
+type lengthFieldProtocol struct {
+	config  *LengthFieldConfig
+	header  []byte
+	value   []byte
+	maxSize int
+}
+
+// LengthFieldProtocol makes a factory of the frame layout, it panics
+// if the layout is invalid.
+func LengthFieldProtocol(config LengthFieldConfig) ProtocolFactory {
+	switch config.Width {
+	case 1, 2, 3, 4, 8, VarintWidth:
+	default:
+		panic("gotransport: invalid length field width")
+	}
+	if config.Offset < 0 || config.Strip < 0 {
+		panic("gotransport: invalid length field offset")
+	}
+	return func() Protocol {
+		return &lengthFieldProtocol{config: &config}
+	}
+}
+
+func (p *lengthFieldProtocol) Payload() []byte {
+	return p.value
+}
+
+func (p *lengthFieldProtocol) SetPayload(payload []byte) {
+	p.value = payload
+}
+
+// SetFlagOptions sets the header bytes before the length field,
+// the length must equal to Offset.
+func (p *lengthFieldProtocol) SetFlagOptions(value interface{}) error {
+	if header, ok := value.([]byte); ok && len(header) == p.config.Offset {
+		p.header = header
+		return nil
+	}
+	return ErrTypeNotSupport
+}
+
+func (p *lengthFieldProtocol) FlagOptions() Value {
+	return WrapValue(p.header)
+}
+
+func (p *lengthFieldProtocol) SetMaxSize(size int) {
+	p.maxSize = size
+}
+
+func (p *lengthFieldProtocol) WriteTo(w io.Writer) (int, error) {
+	c := p.config
+	length := len(p.value) - c.Adjustment
+	if length < 0 {
+		return 0, ErrBadLength
+	}
+	if size, limit := len(p.value)+c.Offset+c.Width, sizeLimit(p.maxSize); size > limit {
+		return 0, &PacketSizeError{Size: int64(size), Limit: limit}
+	}
+
+	frame := make([]byte, c.Offset, c.Offset+binary.MaxVarintLen64+len(p.value))
+	copy(frame, p.header)
+	if c.Width == VarintWidth {
+		var buf [binary.MaxVarintLen64]byte
+		frame = append(frame, buf[:binary.PutUvarint(buf[:], uint64(length))]...)
+	} else {
+		if c.Width < 8 && uint64(length) >= 1<<(8*uint(c.Width)) {
+			return 0, ErrTooLarge
+		}
+		frame = append(frame, putUint(uint64(length), c.Width, c.LittleEndian)...)
+	}
+	frame = append(frame, p.value...)
+	return w.Write(frame)
+}
+
+func (p *lengthFieldProtocol) ReadFrom(r io.Reader) (int, error) {
+	c := p.config
+	frame := make([]byte, c.Offset, c.Offset+8)
+	n, err := io.ReadFull(r, frame)
+	if err != nil {
+		return n, err
+	}
+
+	var length uint64
+	if c.Width == VarintWidth {
+		br := &recordReader{r: r, data: frame}
+		length, err = binary.ReadUvarint(br)
+		frame = br.data
+		n = len(frame)
+		if err != nil {
+			return n, err
+		}
+	} else {
+		field := make([]byte, c.Width)
+		m, err := io.ReadFull(r, field)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		length = getUint(field, c.LittleEndian)
+		frame = append(frame, field...)
+	}
+
+	limit := sizeLimit(p.maxSize)
+	if length > uint64(limit) {
+		size := int64(math.MaxInt64)
+		if length < math.MaxInt64/2 {
+			size = int64(len(frame)) + int64(length)
+		}
+		return n, &PacketSizeError{Size: size, Limit: limit}
+	}
+	size := int64(length) + int64(c.Adjustment)
+	if size < 0 || int64(c.Strip) > int64(len(frame))+size {
+		return n, ErrBadLength
+	}
+	if int64(len(frame))+size > int64(limit) {
+		return n, &PacketSizeError{Size: int64(len(frame)) + size, Limit: limit}
+	}
+
+	body := make([]byte, size)
+	m, err := io.ReadFull(r, body)
+	n += m
+	if err != nil {
+		return n, err
+	}
+	frame = append(frame, body...)
+
+	p.header = frame[:c.Offset]
+	p.value = frame[c.Strip:]
+	return n, nil
+}
+
+// recordReader is an io.ByteReader that records the bytes read.
+type recordReader struct {
+	r    io.Reader
+	data []byte
+}
+
+func (b *recordReader) ReadByte() (byte, error) {
+	var buf [1]byte
+	if _, err := io.ReadFull(b.r, buf[:]); err != nil {
+		return 0, err
+	}
+	b.data = append(b.data, buf[0])
+	return buf[0], nil
+}
+
+func putUint(v uint64, width int, littleEndian bool) []byte {
+	b := make([]byte, width)
+	for i := 0; i < width; i++ {
+		shift := uint(8 * i)
+		if littleEndian {
+			b[i] = byte(v >> shift)
+		} else {
+			b[width-1-i] = byte(v >> shift)
+		}
+	}
+	return b
+}
+
+func getUint(b []byte, littleEndian bool) uint64 {
+	var v uint64
+	for i := range b {
+		if littleEndian {
+			v |= uint64(b[i]) << uint(8*i)
+		} else {
+			v = v<<8 | uint64(b[i])
+		}
+	}
+	return v
+}
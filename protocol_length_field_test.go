@@ -0,0 +1,53 @@
+package gotransport
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLengthField(t *testing.T) {
+	cases := []struct {
+		config LengthFieldConfig
+		header []byte
+		frame  []byte
+	}{
+		// 2-byte little-endian length
+		{LengthFieldConfig{Width: 2, LittleEndian: true, Strip: 2}, []byte{},
+			[]byte{3, 0, 'a', 'b', 'c'}},
+		// varint length after a 1-byte header
+		{LengthFieldConfig{Offset: 1, Width: VarintWidth, Strip: 2}, []byte{9},
+			[]byte{9, 3, 'a', 'b', 'c'}},
+		// 3-byte big-endian length that includes the header
+		{LengthFieldConfig{Offset: 1, Width: 3, Adjustment: -4, Strip: 4}, []byte{7},
+			[]byte{7, 0, 0, 7, 'a', 'b', 'c'}},
+	}
+	for _, c := range cases {
+		p := LengthFieldProtocol(c.config)()
+		assertErr(p.SetFlagOptions(c.header))
+		p.SetPayload([]byte("abc"))
+
+		buf := &bytes.Buffer{}
+		n, err := p.WriteTo(buf)
+		assertErr(err)
+		assert(n == len(c.frame))
+		assert(bytes.Equal(buf.Bytes(), c.frame))
+
+		p2 := LengthFieldProtocol(c.config)()
+		n, err = p2.ReadFrom(buf)
+		assertErr(err)
+		assert(n == len(c.frame))
+		assert(string(p2.Payload()) == "abc")
+		assert(bytes.Equal(p2.FlagOptions().Bytes(), c.header))
+	}
+
+	// keep the header in the payload
+	p := LengthFieldProtocol(LengthFieldConfig{Offset: 1, Width: 1})()
+	_, err := p.ReadFrom(bytes.NewReader([]byte{7, 2, 'h', 'i'}))
+	assertErr(err)
+	assert(bytes.Equal(p.Payload(), []byte{7, 2, 'h', 'i'}))
+
+	// negative adjusted length
+	p = LengthFieldProtocol(LengthFieldConfig{Width: 1, Adjustment: -2})()
+	_, err = p.ReadFrom(bytes.NewReader([]byte{1, 'x'}))
+	assert(err == ErrBadLength)
+}
@@ -2,17 +2,59 @@ package gotransport
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 )
 
+// lineProtocol
+// Frames are ended by a delimiter, "\n" by default, in which case a
+// "\r\n" ending is accepted as well. The reader passed to ReadFrom is
+// used as is if it is a *bufio.Reader (as the transport does), so the
+// bytes after the delimiter are kept for the next read; other readers
+// are read byte by byte.
 type lineProtocol struct {
-	data []byte
+	delim   []byte // nil means "\n" or "\r\n"
+	keep    bool   // keep the delimiter in the payload
+	data    []byte
+	maxSize int
 }
 
 func LineProtocol() Protocol {
 	return &lineProtocol{}
 }
 
+// DelimiterProtocol makes a factory of frames ended by delim, such as
+// []byte{0} or []byte("\r\n"). The delimiter is stripped from the payload
+// unless keep is true.
+func DelimiterProtocol(delim []byte, keep bool) ProtocolFactory {
+	if len(delim) == 0 {
+		panic("gotransport: empty delimiter")
+	}
+	delim = append([]byte(nil), delim...)
+	return func() Protocol {
+		return &lineProtocol{delim: delim, keep: keep}
+	}
+}
+
+func (l *lineProtocol) delimiter() []byte {
+	if l.delim == nil {
+		return []byte{'\n'}
+	}
+	return l.delim
+}
+
+// trim strips the delimiter kept in the payload.
+func (l *lineProtocol) trim(data []byte) []byte {
+	if !l.keep {
+		return data
+	}
+	data = bytes.TrimSuffix(data, l.delimiter())
+	if l.delim == nil {
+		data = bytes.TrimSuffix(data, []byte{'\r'})
+	}
+	return data
+}
+
 func (l *lineProtocol) Payload() []byte {
 	return l.data
 }
@@ -29,14 +71,22 @@ func (l *lineProtocol) FlagOptions() Value {
 	return nil
 }
 
+func (l *lineProtocol) SetMaxSize(size int) {
+	l.maxSize = size
+}
+
 func (l *lineProtocol) WriteTo(w io.Writer) (int, error) {
 	if len(l.data) <= 0 {
 		return 0, nil
 	}
-	if l.data[len(l.data)-1] != '\n' {
-		l.data = append(l.data, '\n')
+	frame := l.data
+	if delim := l.delimiter(); !bytes.HasSuffix(frame, delim) {
+		frame = append(frame[:len(frame):len(frame)], delim...)
 	}
-	return w.Write(l.data)
+	if size, limit := len(frame), sizeLimit(l.maxSize); size > limit {
+		return 0, &PacketSizeError{Size: int64(size), Limit: limit}
+	}
+	return w.Write(frame)
 }
 
 //func (p *lineProtocol) ReadFrom(r io.Reader) (int, error) {
@@ -63,21 +113,57 @@ func (l *lineProtocol) WriteTo(w io.Writer) (int, error) {
 //}
 
 func (p *lineProtocol) ReadFrom(r io.Reader) (int, error) {
-	line, err := bufio.NewReader(r).ReadBytes('\n')
-	n := len(line)
-	if err != nil {
-		return n, err
+	var (
+		delim = p.delimiter()
+		limit = sizeLimit(p.maxSize)
+		line  []byte
+	)
+	for {
+		part, err := readSlice(r, delim[len(delim)-1])
+		line = append(line, part...)
+		if len(line) > limit {
+			return len(line), &PacketSizeError{Size: int64(len(line)), Limit: limit}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return len(line), err
+		}
+		if bytes.HasSuffix(line, delim) {
+			break
+		}
 	}
+	n := len(line)
 
-	// Handle the case "\r\n".
-	if len(line) > 0 && line[len(line)-1] == '\n' {
-		drop := 1
-		if len(line) > 1 && line[len(line)-2] == '\r' {
-			drop = 2
+	if !p.keep {
+		line = line[:len(line)-len(delim)]
+		// Handle the case "\r\n".
+		if p.delim == nil && len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
 		}
-		line = line[:len(line)-drop]
 	}
 
 	p.data = line
 	return n, nil
 }
+
+// readSlice reads until the first occurrence of delim, see bufio.Reader.ReadSlice.
+func readSlice(r io.Reader, delim byte) ([]byte, error) {
+	if br, ok := r.(*bufio.Reader); ok {
+		return br.ReadSlice(delim)
+	}
+	var (
+		line []byte
+		buf  [1]byte
+	)
+	for {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return line, err
+		}
+		line = append(line, buf[0])
+		if buf[0] == delim {
+			return line, nil
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package gotransport
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestLine(t *testing.T) {
+	// the reader is shared by reads, nothing after the first line is lost
+	reader := bufio.NewReader(bytes.NewBufferString("hello\r\nworld\n"))
+	for _, want := range []string{"hello", "world"} {
+		p := LineProtocol()
+		_, err := p.ReadFrom(reader)
+		assertErr(err)
+		assert(string(p.Payload()) == want)
+	}
+
+	buf := &bytes.Buffer{}
+	for _, keep := range []bool{false, true} {
+		factory := DelimiterProtocol([]byte("\r\n"), keep)
+		p := factory()
+		p.SetPayload([]byte("a\rb\nc"))
+		_, err := p.WriteTo(buf)
+		assertErr(err)
+		assert(buf.String() == "a\rb\nc\r\n")
+
+		p2 := factory()
+		_, err = p2.ReadFrom(buf)
+		assertErr(err)
+		if keep {
+			assert(string(p2.Payload()) == "a\rb\nc\r\n")
+		} else {
+			assert(string(p2.Payload()) == "a\rb\nc")
+		}
+	}
+
+	p := DelimiterProtocol([]byte{0}, false)()
+	_, err := p.ReadFrom(bytes.NewBuffer([]byte{'x', 0, 'y', 0}))
+	assertErr(err)
+	assert(string(p.Payload()) == "x")
+}
@@ -12,6 +12,10 @@ var ErrTooLarge = errors.New("packet: too large")
 const (
 	MaxPacketSize = 1024 * 1024 * 100 // 100MB
 	HeaderSize    = 5                 // type(1-byte) + length(4-byte)
+
+	// ControlTagMin is the first type reserved for control frames,
+	// see ControlProtocol.
+	ControlTagMin = 0xF0
 )
 
 // packetProtocol
@@ -24,8 +28,9 @@ const (
 //       \-----------------------/
 //            header(5-byte)
 type packetProtocol struct {
-	tag   byte
-	value []byte
+	tag     byte
+	value   []byte
+	maxSize int
 }
 
 func PacketProtocol() Protocol {
@@ -52,9 +57,21 @@ func (p *packetProtocol) FlagOptions() Value {
 	return WrapValue(p.tag)
 }
 
+func (p *packetProtocol) SetMaxSize(size int) {
+	p.maxSize = size
+}
+
+func (p *packetProtocol) SetControl(kind byte) {
+	p.tag = kind
+}
+
+func (p *packetProtocol) Control() (byte, bool) {
+	return p.tag, p.tag >= ControlTagMin
+}
+
 func (p *packetProtocol) WriteTo(w io.Writer) (int, error) {
-	if len(p.value)+HeaderSize > MaxPacketSize {
-		return 0, ErrTooLarge
+	if size, limit := len(p.value)+HeaderSize, sizeLimit(p.maxSize); size > limit {
+		return 0, &PacketSizeError{Size: int64(size), Limit: limit}
 	}
 	var (
 		total int
@@ -94,8 +111,8 @@ func (p *packetProtocol) ReadFrom(r io.Reader) (int, error) {
 	}
 	total += 4
 
-	if length+HeaderSize > MaxPacketSize {
-		return total, ErrTooLarge
+	if size, limit := int64(length)+HeaderSize, sizeLimit(p.maxSize); size > int64(limit) {
+		return total, &PacketSizeError{Size: size, Limit: limit}
 	}
 
 	var value = make([]byte, length)
@@ -2,6 +2,7 @@ package gotransport
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 )
 
@@ -50,3 +51,21 @@ func TestPacket_Pack(t *testing.T) {
 	assert(n == 7)
 	assert(bytes.Compare(buf2.Bytes(), packedData) == 0)
 }
+
+func TestPacket_MaxSize(t *testing.T) {
+	// a header claiming a 4GB value must not be allocated
+	p := packetProtocol{}
+	_, err := p.Unpack([]byte{1, 0xFF, 0xFF, 0xFF, 0xFF})
+	assert(errors.Is(err, ErrTooLarge))
+
+	p.SetMaxSize(8)
+	p.SetPayload([]byte("abcd"))
+	_, err = p.Pack()
+	se, ok := err.(*PacketSizeError)
+	assert(ok && se.Size == 9 && se.Limit == 8)
+
+	l := LineProtocol()
+	l.(SizeLimiter).SetMaxSize(4)
+	_, err = l.ReadFrom(bytes.NewBufferString("abcdef\n"))
+	assert(errors.Is(err, ErrTooLarge))
+}
@@ -33,7 +33,12 @@ func (p *rawProtocol) WriteTo(w io.Writer) (int, error) {
 }
 
 func (p *rawProtocol) ReadFrom(r io.Reader) (int, error) {
-	p.data = make([]byte, BufferSize)
+	size := BufferSize
+	// a datagram is read whole
+	if l, ok := r.(interface{ Len() int }); ok && l.Len() > size {
+		size = l.Len()
+	}
+	p.data = make([]byte, size)
 	n, err := r.Read(p.data)
 	p.data = p.data[:n]
 	return n, err
@@ -0,0 +1,238 @@
+package gotransport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrTampered = errors.New("seal: message authentication failed")
+	ErrReplayed = errors.New("seal: replayed frame")
+	ErrUnbound  = errors.New("seal: protocol is not bound to a transport")
+)
+
+const (
+	// sealSaltSize is the size of the random salt of the key of a direction.
+	sealSaltSize = 16
+	// sealHeaderSize is the size of the salt and counter in front of the
+	// sealed payload.
+	sealHeaderSize = sealSaltSize + 8
+)
+
+// SealProtocol wraps the inner protocol, every payload is sealed with
+// AES-256-GCM under a key derived from the key.
+//
+// The sealed payload is
+//
+//  [ salt (16) ][ counter (8) ][ ciphertext and tag ]
+//
+// Each direction of a transport picks a random salt, and seals with the
+// key derived from the key and the salt by HKDF-SHA256, so every direction
+// of every connection has its own key. The counter grows by one with every
+// packet of the direction and is the nonce, so nonces are never reused
+// under a key. The flag options of the inner protocol are authenticated
+// as well. A frame that fails to open closes the transport with
+// ErrTampered, a frame whose counter isn't greater than the last one,
+// or of another salt than the first one, closes it with ErrReplayed.
+//
+// The inner protocol must frame by length, as the ciphertext may contain
+// any delimiter. The salts and counters are kept per transport, so the
+// packets have to be made by or written to a transport, see TransportBinder.
+// A direction recorded from its first frame and replayed as a new
+// connection is only rejected if each connection has its own key, see
+// SealProtocolFunc.
+func SealProtocol(inner ProtocolFactory, key []byte) ProtocolFactory {
+	return SealProtocolFunc(inner, func(Transport) ([]byte, error) {
+		return key, nil
+	})
+}
+
+// SealProtocolFunc is like SealProtocol, but asks for the key of each
+// transport, e.g. a key of the identity of the peer.
+func SealProtocolFunc(inner ProtocolFactory, key func(t Transport) ([]byte, error)) ProtocolFactory {
+	s := &sealer{key: key}
+	return func() Protocol {
+		return wrap(inner(), &sealBinding{sealer: s})
+	}
+}
+
+// NewAESGCM returns the AES-GCM aead of the 16, 24 or 32 bytes key.
+func NewAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAEAD returns the aead of the key derived from the key and salt,
+// by HKDF-SHA256 (RFC 5869) with the salt.
+func sealAEAD(key, salt []byte) (cipher.AEAD, error) {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(sealInfo))
+	expand.Write([]byte{1})
+	return NewAESGCM(expand.Sum(nil))
+}
+
+// sealInfo is the HKDF info of the derived keys.
+const sealInfo = "gotransport.seal"
+
+// sealer keeps the sessions of the transports using the factory.
+type sealer struct {
+	key      func(t Transport) ([]byte, error)
+	sessions sync.Map // transport id -> *sealSession
+}
+
+func (s *sealer) session(t Transport) *sealSession {
+	if v, ok := s.sessions.Load(t.ID()); ok {
+		session := v.(*sealSession)
+		session.init(s, t)
+		return session
+	}
+	v, loaded := s.sessions.LoadOrStore(t.ID(), &sealSession{})
+	if !loaded {
+		go func() {
+			<-t.Context().Done()
+			s.sessions.Delete(t.ID())
+		}()
+	}
+	session := v.(*sealSession)
+	session.init(s, t)
+	return session
+}
+
+type sealSession struct {
+	once sync.Once
+	key  []byte
+	salt [sealSaltSize]byte
+	aead cipher.AEAD // of the salt sent
+	err  error
+
+	mu       sync.Mutex
+	sent     uint64
+	peer     [sealSaltSize]byte
+	peerAEAD cipher.AEAD // nil until a frame of the peer is opened
+	received uint64      // the smallest counter accepted next
+}
+
+func (s *sealSession) init(sealer *sealer, t Transport) {
+	s.once.Do(func() {
+		if s.key, s.err = sealer.key(t); s.err != nil {
+			return
+		}
+		if _, s.err = rand.Read(s.salt[:]); s.err != nil {
+			return
+		}
+		s.aead, s.err = sealAEAD(s.key, s.salt[:])
+	})
+}
+
+func sealNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+// sealBinding is the payloadTransformer of a packet,
+// it seals with the session of the transport bound.
+type sealBinding struct {
+	sealer  *sealer
+	session *sealSession
+}
+
+func (b *sealBinding) BindTransport(t Transport) {
+	b.session = b.sealer.session(t)
+}
+
+func (b *sealBinding) encode(inner Protocol, payload []byte) ([]byte, error) {
+	s := b.session
+	if s == nil {
+		return nil, ErrUnbound
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	s.mu.Lock()
+	counter := s.sent
+	s.sent++
+	s.mu.Unlock()
+
+	data := make([]byte, sealHeaderSize, sealHeaderSize+len(payload)+s.aead.Overhead())
+	copy(data, s.salt[:])
+	binary.BigEndian.PutUint64(data[sealSaltSize:], counter)
+	return s.aead.Seal(data, sealNonce(s.aead, counter), payload, sealedData(inner)), nil
+}
+
+func (b *sealBinding) decode(inner Protocol, data []byte, maxSize int) ([]byte, error) {
+	s := b.session
+	if s == nil {
+		return nil, ErrUnbound
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	if len(data) < sealHeaderSize+s.aead.Overhead() {
+		return nil, ErrTampered
+	}
+	salt, counter := data[:sealSaltSize], binary.BigEndian.Uint64(data[sealSaltSize:sealHeaderSize])
+	// a frame of our own is reflected back
+	if string(salt) == string(s.salt[:]) {
+		return nil, ErrTampered
+	}
+
+	s.mu.Lock()
+	aead := s.peerAEAD
+	other := aead != nil && string(salt) != string(s.peer[:])
+	s.mu.Unlock()
+	if aead == nil || other {
+		var err error
+		if aead, err = sealAEAD(s.key, salt); err != nil {
+			return nil, err
+		}
+	}
+	payload, err := aead.Open(nil, sealNonce(aead, counter), data[sealHeaderSize:], sealedData(inner))
+	if err != nil {
+		return nil, ErrTampered
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a frame of another connection under the key
+	if other {
+		return nil, ErrReplayed
+	}
+	if counter < s.received {
+		return nil, ErrReplayed
+	}
+	if s.peerAEAD == nil {
+		copy(s.peer[:], salt)
+		s.peerAEAD = aead
+	}
+	s.received = counter + 1
+	return payload, nil
+}
+
+// sealedData returns the flag options of the inner protocol,
+// which are authenticated with the payload.
+func sealedData(inner Protocol) []byte {
+	options := inner.FlagOptions()
+	if options == nil {
+		return nil
+	}
+	switch v := options.Raw().(type) {
+	case byte:
+		return []byte{v}
+	case []byte:
+		return v
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package gotransport
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSeal(t *testing.T) {
+	factory := SealProtocol(PacketProtocol, bytes.Repeat([]byte{7}, 32))
+
+	// pipe returns the sending transport, its conn, and the receiving transport
+	pipe := func(received chan []byte) (Transport, net.Conn, Transport) {
+		opts := MakeOptions()
+		WithProtocol(factory)(opts)
+		WithMessage(func(transport Transport, packet Protocol) {
+			received <- packet.Payload()
+		})(opts)
+		c1, c2 := net.Pipe()
+		t1 := NewTransport(context.Background(), c1, opts).LoopAsync()
+		t2 := NewTransport(context.Background(), c2, opts).LoopAsync()
+		return t1, c1, t2
+	}
+	frame := func(t1 Transport, payload string) []byte {
+		packet := t1.ProtocolMake()
+		packet.SetPayload([]byte(payload))
+		buf := &bytes.Buffer{}
+		_, err := packet.WriteTo(buf)
+		assertErr(err)
+		assert(!bytes.Contains(buf.Bytes(), []byte(payload)))
+		return buf.Bytes()
+	}
+	closed := func(t2 Transport) error {
+		select {
+		case <-t2.Context().Done():
+			return t2.Err()
+		case <-time.After(time.Second):
+			panic("transport not closed")
+		}
+	}
+
+	received := make(chan []byte, 4)
+	t1, c1, t2 := pipe(received)
+	_, err := t1.WriteString("hello")
+	assertErr(err)
+	assert(string(<-received) == "hello")
+
+	// replay
+	data := frame(t1, "once")
+	_, err = c1.Write(data)
+	assertErr(err)
+	assert(string(<-received) == "once")
+	c1.Write(data)
+	assert(closed(t2) == ErrReplayed)
+	t1.Close()
+
+	// tamper
+	t1, c1, t2 = pipe(received)
+	data = frame(t1, "hello")
+	data[len(data)-1] ^= 1
+	c1.Write(data)
+	assert(closed(t2) == ErrTampered)
+	t1.Close()
+
+	// not bound to a transport
+	p := factory()
+	p.SetPayload([]byte("hello"))
+	_, err = p.WriteTo(&bytes.Buffer{})
+	assert(err == ErrUnbound)
+}
+
+func TestSealSessions(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	sealer := &sealer{key: func(Transport) ([]byte, error) {
+		return key, nil
+	}}
+	inner := PacketProtocol()
+	seal := func(s *sealSession) []byte {
+		b := &sealBinding{sealer: sealer, session: s}
+		data, err := b.encode(inner, []byte("hello"))
+		assertErr(err)
+		return data
+	}
+
+	// two sessions under one key seal with their own keys,
+	// the same payload at the same counter differs
+	s1, s2 := &sealSession{}, &sealSession{}
+	s1.init(sealer, nil)
+	s2.init(sealer, nil)
+	assert(s1.salt != s2.salt)
+	d1, d2 := seal(s1), seal(s2)
+	assert(!bytes.Equal(d1[sealHeaderSize:], d2[sealHeaderSize:]))
+
+	// the key is derived from the salt
+	aead, err := sealAEAD(key, s1.salt[:])
+	assertErr(err)
+	payload, err := aead.Open(nil, sealNonce(aead, 0), d1[sealHeaderSize:], sealedData(inner))
+	assertErr(err)
+	assert(string(payload) == "hello")
+	_, err = aead.Open(nil, sealNonce(aead, 0), d2[sealHeaderSize:], sealedData(inner))
+	assert(err != nil)
+}
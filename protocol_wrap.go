@@ -0,0 +1,92 @@
+package gotransport
+
+import (
+	"io"
+)
+
+// payloadTransformer transforms the payload carried by an inner protocol,
+// such as compression and encryption.
+type payloadTransformer interface {
+	encode(inner Protocol, payload []byte) ([]byte, error)
+	decode(inner Protocol, data []byte, maxSize int) ([]byte, error)
+}
+
+// wrapProtocol carries the transformed payload with the inner protocol,
+// the flag options, control frames and size limit go to the inner one.
+type wrapProtocol struct {
+	inner       Protocol
+	transformer payloadTransformer
+	payload     []byte
+	maxSize     int
+}
+
+// wrap returns the wrapper, which is a ControlProtocol only if inner is.
+func wrap(inner Protocol, transformer payloadTransformer) Protocol {
+	p := &wrapProtocol{inner: inner, transformer: transformer}
+	if _, ok := inner.(ControlProtocol); ok {
+		return &wrapControlProtocol{p}
+	}
+	return p
+}
+
+func (p *wrapProtocol) Payload() []byte {
+	return p.payload
+}
+
+func (p *wrapProtocol) SetPayload(payload []byte) {
+	p.payload = payload
+}
+
+func (p *wrapProtocol) SetFlagOptions(value interface{}) error {
+	return p.inner.SetFlagOptions(value)
+}
+
+func (p *wrapProtocol) FlagOptions() Value {
+	return p.inner.FlagOptions()
+}
+
+func (p *wrapProtocol) SetMaxSize(size int) {
+	p.maxSize = size
+	if l, ok := p.inner.(SizeLimiter); ok {
+		l.SetMaxSize(size)
+	}
+}
+
+func (p *wrapProtocol) BindTransport(t Transport) {
+	if b, ok := p.transformer.(TransportBinder); ok {
+		b.BindTransport(t)
+	}
+	if b, ok := p.inner.(TransportBinder); ok {
+		b.BindTransport(t)
+	}
+}
+
+func (p *wrapProtocol) WriteTo(w io.Writer) (int, error) {
+	data, err := p.transformer.encode(p.inner, p.payload)
+	if err != nil {
+		return 0, err
+	}
+	p.inner.SetPayload(data)
+	return p.inner.WriteTo(w)
+}
+
+func (p *wrapProtocol) ReadFrom(r io.Reader) (int, error) {
+	n, err := p.inner.ReadFrom(r)
+	if err != nil {
+		return n, err
+	}
+	p.payload, err = p.transformer.decode(p.inner, p.inner.Payload(), sizeLimit(p.maxSize))
+	return n, err
+}
+
+type wrapControlProtocol struct {
+	*wrapProtocol
+}
+
+func (p *wrapControlProtocol) SetControl(kind byte) {
+	p.inner.(ControlProtocol).SetControl(kind)
+}
+
+func (p *wrapControlProtocol) Control() (byte, bool) {
+	return p.inner.(ControlProtocol).Control()
+}
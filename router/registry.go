@@ -0,0 +1,76 @@
+package router
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/luweimy/gotransport"
+	"github.com/luweimy/gotransport/codec"
+)
+
+// Registry maps Go types to packet tags, it is a gotransport.MessageCodec:
+//
+//	registry := router.NewRegistry(codec.JSONCodec{})
+//	registry.RegisterType(1, &Login{})
+//	server.Options(gotransport.WithMessageCodec(registry))
+//	...
+//	transport.Send(&Login{Name: "alice"})
+type Registry struct {
+	codec codec.Codec
+
+	mu    sync.RWMutex
+	tags  map[reflect.Type]byte
+	types map[byte]reflect.Type
+}
+
+func NewRegistry(c codec.Codec) *Registry {
+	return &Registry{
+		codec: c,
+		tags:  make(map[reflect.Type]byte),
+		types: make(map[byte]reflect.Type),
+	}
+}
+
+// RegisterType binds the tag to the type of prototype, the messages are
+// decoded into values of the same type, pointer or not.
+func (r *Registry) RegisterType(tag byte, prototype interface{}) {
+	typ := reflect.TypeOf(prototype)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tags[typ] = tag
+	r.types[tag] = typ
+}
+
+func (r *Registry) Marshal(msg interface{}, packet gotransport.Protocol) error {
+	r.mu.RLock()
+	tag, ok := r.tags[reflect.TypeOf(msg)]
+	r.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("router: type %T not registered", msg)
+	}
+
+	data, err := r.codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	if err := packet.SetFlagOptions(tag); err != nil {
+		return err
+	}
+	packet.SetPayload(data)
+	return nil
+}
+
+func (r *Registry) Unmarshal(packet gotransport.Protocol) (interface{}, error) {
+	tag, ok := Tag(packet)
+	if !ok {
+		return nil, gotransport.ErrUnknownMessage
+	}
+	r.mu.RLock()
+	typ, ok := r.types[tag]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, gotransport.ErrUnknownMessage
+	}
+	return decode(r.codec, typ, packet.Payload())
+}
@@ -0,0 +1,123 @@
+package router
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/luweimy/gotransport"
+	"github.com/luweimy/gotransport/codec"
+)
+
+// TypedHandler receives the decoded message, msg has the type of the
+// prototype given to HandleTyped.
+type TypedHandler func(transport gotransport.Transport, msg interface{})
+
+// ErrorHandler is called when the payload of a typed handler can't be decoded.
+type ErrorHandler func(transport gotransport.Transport, packet gotransport.Protocol, err error)
+
+// Router dispatches the packets by the tag of PacketProtocol, see
+// Protocol.FlagOptions. Install Router.OnMessage with gotransport.WithMessage.
+type Router struct {
+	mu       sync.RWMutex
+	handlers map[byte]gotransport.MessageHandler
+	fallback gotransport.MessageHandler
+	onError  ErrorHandler
+}
+
+func New() *Router {
+	return &Router{
+		handlers: make(map[byte]gotransport.MessageHandler),
+	}
+}
+
+// Handle registers the handler for the tag.
+func (r *Router) Handle(tag byte, handler gotransport.MessageHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[tag] = handler
+}
+
+// HandleTyped registers a handler for the tag, the payload is decoded
+// with the codec into a new value of the same type as prototype.
+// If prototype is a pointer, handler receives a pointer to a new value.
+func (r *Router) HandleTyped(tag byte, c codec.Codec, prototype interface{}, handler TypedHandler) {
+	typ := reflect.TypeOf(prototype)
+	r.Handle(tag, func(transport gotransport.Transport, packet gotransport.Protocol) {
+		msg, err := decode(c, typ, packet.Payload())
+		if err != nil {
+			r.error(transport, packet, err)
+			return
+		}
+		handler(transport, msg)
+	})
+}
+
+// Fallback registers the handler for unknown tags and
+// protocols without tag, by default they are dropped.
+func (r *Router) Fallback(handler gotransport.MessageHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = handler
+}
+
+// OnError registers the handler of decoding errors,
+// by default the transport is closed with the error.
+func (r *Router) OnError(handler ErrorHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onError = handler
+}
+
+// OnMessage is a gotransport.MessageHandler.
+func (r *Router) OnMessage(transport gotransport.Transport, packet gotransport.Protocol) {
+	r.mu.RLock()
+	handler := r.fallback
+	if tag, ok := Tag(packet); ok {
+		if h, ok := r.handlers[tag]; ok {
+			handler = h
+		}
+	}
+	r.mu.RUnlock()
+
+	if handler != nil {
+		handler(transport, packet)
+	}
+}
+
+func (r *Router) error(transport gotransport.Transport, packet gotransport.Protocol, err error) {
+	r.mu.RLock()
+	onError := r.onError
+	r.mu.RUnlock()
+
+	if onError != nil {
+		onError(transport, packet, err)
+		return
+	}
+	transport.CloseWithError(err)
+}
+
+// Tag returns the tag byte of the packet, false if the protocol has no tag.
+func Tag(packet gotransport.Protocol) (byte, bool) {
+	v := packet.FlagOptions()
+	if v == nil {
+		return 0, false
+	}
+	tag, ok := v.Raw().(byte)
+	return tag, ok
+}
+
+// decode decodes data into a new value of typ.
+func decode(c codec.Codec, typ reflect.Type, data []byte) (interface{}, error) {
+	if typ.Kind() == reflect.Ptr {
+		v := reflect.New(typ.Elem())
+		if err := c.Decode(data, v.Interface()); err != nil {
+			return nil, err
+		}
+		return v.Interface(), nil
+	}
+	v := reflect.New(typ)
+	if err := c.Decode(data, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
@@ -0,0 +1,88 @@
+package router
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/luweimy/gotransport"
+	"github.com/luweimy/gotransport/codec"
+)
+
+type login struct {
+	Name string
+}
+
+func TestRouter(t *testing.T) {
+	received := make(chan interface{}, 2)
+	r := New()
+	r.HandleTyped(1, codec.JSONCodec{}, &login{}, func(transport gotransport.Transport, msg interface{}) {
+		received <- msg
+	})
+	r.Fallback(func(transport gotransport.Transport, packet gotransport.Protocol) {
+		received <- string(packet.Payload())
+	})
+
+	c1, c2 := net.Pipe()
+	t1 := gotransport.NewTransport(context.Background(), c1, nil)
+	defer t1.Close()
+	opts := gotransport.MakeOptions()
+	gotransport.WithMessage(r.OnMessage)(opts)
+	gotransport.NewTransport(context.Background(), c2, opts).LoopAsync()
+
+	write := func(tag byte, payload string) {
+		packet := t1.ProtocolMake()
+		packet.SetFlagOptions(tag)
+		packet.SetPayload([]byte(payload))
+		t1.WritePacket(packet)
+	}
+	write(1, `{"Name":"alice"}`)
+	write(2, "unknown")
+
+	for _, want := range []interface{}{"alice", "unknown"} {
+		select {
+		case msg := <-received:
+			if l, ok := msg.(*login); ok {
+				msg = l.Name
+			}
+			if msg != want {
+				t.Fatalf("msg = %v, want %v", msg, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message not routed")
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry(codec.JSONCodec{})
+	registry.RegisterType(1, &login{})
+
+	received := make(chan interface{}, 1)
+	opts := gotransport.MakeOptions()
+	gotransport.WithMessageCodec(registry)(opts)
+	gotransport.WithTypedMessage(func(transport gotransport.Transport, msg interface{}) {
+		received <- msg
+	})(opts)
+
+	c1, c2 := net.Pipe()
+	t1 := gotransport.NewTransport(context.Background(), c1, opts)
+	defer t1.Close()
+	gotransport.NewTransport(context.Background(), c2, opts).LoopAsync()
+
+	if err := t1.Send(login{Name: "bob"}); err == nil {
+		t.Fatal("unregistered type should fail")
+	}
+	if err := t1.Send(&login{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if l, ok := msg.(*login); !ok || l.Name != "alice" {
+			t.Fatalf("msg = %#v, want &login{alice}", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+}
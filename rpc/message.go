@@ -0,0 +1,60 @@
+package rpc
+
+import (
+	"encoding/binary"
+)
+
+const (
+	kindRequest  byte = 1
+	kindResponse byte = 2
+)
+
+// message format:
+//  [kind(1-byte)][seq(8-byte)][method-len(2-byte)][method][error-len(2-byte)][error][body...]
+type message struct {
+	kind   byte
+	seq    uint64
+	method string
+	error  string
+	body   []byte
+}
+
+func (m *message) marshal() ([]byte, error) {
+	if len(m.method) > 0xFFFF || len(m.error) > 0xFFFF {
+		return nil, ErrMalformed
+	}
+	data := make([]byte, 13+len(m.method)+len(m.error)+len(m.body))
+	data[0] = m.kind
+	binary.BigEndian.PutUint64(data[1:9], m.seq)
+	binary.BigEndian.PutUint16(data[9:11], uint16(len(m.method)))
+	n := 11 + copy(data[11:], m.method)
+	binary.BigEndian.PutUint16(data[n:n+2], uint16(len(m.error)))
+	n += 2
+	n += copy(data[n:], m.error)
+	copy(data[n:], m.body)
+	return data, nil
+}
+
+func (m *message) unmarshal(data []byte) error {
+	if len(data) < 11 {
+		return ErrMalformed
+	}
+	m.kind = data[0]
+	m.seq = binary.BigEndian.Uint64(data[1:9])
+	data = data[9:]
+
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < n+2 {
+		return ErrMalformed
+	}
+	m.method, data = string(data[:n]), data[n:]
+
+	n = int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < n {
+		return ErrMalformed
+	}
+	m.error, m.body = string(data[:n]), data[n:]
+	return nil
+}
@@ -0,0 +1,237 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/luweimy/gotransport"
+	"github.com/luweimy/gotransport/codec"
+)
+
+var (
+	ErrShutdown       = errors.New("rpc: transport is shut down")
+	ErrMalformed      = errors.New("rpc: malformed message")
+	ErrMethodNotFound = errors.New("rpc: method not found")
+	ErrBusy           = errors.New("rpc: too many requests in progress")
+)
+
+// DefaultMaxConcurrent is the requests served at once by default.
+const DefaultMaxConcurrent = 1024
+
+// ServerError represents an error returned by the remote handler.
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
+// HandlerFunc serves a remote call, the returned value is encoded as reply.
+type HandlerFunc func(req *Request) (interface{}, error)
+
+// Request is an inbound call.
+type Request struct {
+	Transport gotransport.Transport
+	Method    string
+	Body      []byte
+
+	codec codec.Codec
+}
+
+// Decode decodes the request body into v with the service codec.
+func (r *Request) Decode(v interface{}) error {
+	return r.codec.Decode(r.Body, v)
+}
+
+// Service matches replies with outstanding calls by transport and
+// sequence id, and dispatches inbound calls to registered handlers.
+// One service can be shared by all transports of a server.
+//
+// The messages are carried as packet payload, so the protocol must keep
+// message boundaries, e.g. PacketProtocol.
+type Service struct {
+	codec codec.Codec
+
+	mu            sync.Mutex
+	seq           uint64
+	pending       map[call]chan *message
+	handlers      map[string]HandlerFunc
+	serving       int
+	maxConcurrent int
+}
+
+// call identifies an outstanding call, a reply is taken only from the
+// transport the call was sent on.
+type call struct {
+	transport uint64
+	seq       uint64
+}
+
+func NewService(c codec.Codec) *Service {
+	return &Service{
+		codec:         c,
+		pending:       make(map[call]chan *message),
+		handlers:      make(map[string]HandlerFunc),
+		maxConcurrent: DefaultMaxConcurrent,
+	}
+}
+
+// SetMaxConcurrent sets the requests served at once, the requests beyond
+// it are replied with ErrBusy.
+func (s *Service) SetMaxConcurrent(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxConcurrent = n
+}
+
+// Handle registers the handler for the given method.
+func (s *Service) Handle(method string, handler HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = handler
+}
+
+// Call invokes the method on the peer and waits for the reply,
+// the reply is decoded into resp (resp may be nil).
+func (s *Service) Call(ctx context.Context, transport gotransport.Transport, method string, req, resp interface{}) error {
+	body, err := s.codec.Encode(req)
+	if err != nil {
+		return err
+	}
+
+	replyCh := make(chan *message, 1)
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	key := call{transport: transport.ID(), seq: seq}
+	s.pending[key] = replyCh
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, key)
+		s.mu.Unlock()
+	}()
+
+	if err := s.send(transport, &message{kind: kindRequest, seq: seq, method: method, body: body}); err != nil {
+		return err
+	}
+
+	select {
+	case reply := <-replyCh:
+		if reply.error != "" {
+			return ServerError(reply.error)
+		}
+		if resp == nil {
+			return nil
+		}
+		return s.codec.Decode(reply.body, resp)
+	case <-transport.Context().Done():
+		return ErrShutdown
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OnMessage is a gotransport.MessageHandler, install it with gotransport.WithMessage.
+func (s *Service) OnMessage(transport gotransport.Transport, packet gotransport.Protocol) {
+	m := &message{}
+	if err := m.unmarshal(packet.Payload()); err != nil {
+		return
+	}
+	switch m.kind {
+	case kindRequest:
+		s.mu.Lock()
+		busy := s.serving >= s.maxConcurrent
+		if !busy {
+			s.serving++
+		}
+		s.mu.Unlock()
+		if busy {
+			s.send(transport, &message{kind: kindResponse, seq: m.seq, error: ErrBusy.Error()})
+			return
+		}
+		go func() {
+			defer func() {
+				s.mu.Lock()
+				s.serving--
+				s.mu.Unlock()
+			}()
+			s.serve(transport, m)
+		}()
+	case kindResponse:
+		s.mu.Lock()
+		key := call{transport: transport.ID(), seq: m.seq}
+		replyCh, ok := s.pending[key]
+		delete(s.pending, key)
+		s.mu.Unlock()
+		if !ok {
+			return
+		}
+		// a duplicate reply is dropped rather than blocking the transport
+		select {
+		case replyCh <- m:
+		default:
+		}
+	}
+}
+
+func (s *Service) serve(transport gotransport.Transport, m *message) {
+	s.mu.Lock()
+	handler, ok := s.handlers[m.method]
+	s.mu.Unlock()
+
+	reply := &message{kind: kindResponse, seq: m.seq}
+	if !ok {
+		reply.error = ErrMethodNotFound.Error()
+	} else {
+		v, err := s.call(handler, &Request{Transport: transport, Method: m.method, Body: m.body, codec: s.codec})
+		if err == nil {
+			reply.body, err = s.codec.Encode(v)
+		}
+		if err != nil {
+			reply.error = err.Error()
+		}
+	}
+	s.send(transport, reply)
+}
+
+// call runs the handler, a panic is returned as error, as the
+// handlers run out of the middlewares of the transport.
+func (s *Service) call(handler HandlerFunc, req *Request) (v interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			v, err = nil, fmt.Errorf("rpc: panic in %s: %v", req.Method, r)
+		}
+	}()
+	return handler(req)
+}
+
+func (s *Service) send(transport gotransport.Transport, m *message) error {
+	data, err := m.marshal()
+	if err != nil {
+		return err
+	}
+	packet := transport.ProtocolMake()
+	packet.SetPayload(data)
+	_, err = transport.WritePacket(packet)
+	return err
+}
+
+// Client binds a transport to a service, e.g. a client.Client.
+type Client struct {
+	gotransport.Transport
+	service *Service
+}
+
+func NewClient(transport gotransport.Transport, service *Service) *Client {
+	return &Client{
+		Transport: transport,
+		service:   service,
+	}
+}
+
+// Call invokes the method on the peer and waits for the reply.
+func (c *Client) Call(ctx context.Context, method string, req, resp interface{}) error {
+	return c.service.Call(ctx, c.Transport, method, req, resp)
+}
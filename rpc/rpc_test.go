@@ -0,0 +1,161 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/luweimy/gotransport"
+	"github.com/luweimy/gotransport/codec"
+)
+
+type addArgs struct {
+	A, B int
+}
+
+func TestCall(t *testing.T) {
+	service := NewService(codec.JSONCodec{})
+	service.Handle("add", func(req *Request) (interface{}, error) {
+		args := addArgs{}
+		if err := req.Decode(&args); err != nil {
+			return nil, err
+		}
+		return args.A + args.B, nil
+	})
+
+	c1, c2 := net.Pipe()
+	opts := gotransport.MakeOptions()
+	gotransport.WithMessage(service.OnMessage)(opts)
+	gotransport.NewTransport(context.Background(), c1, opts).LoopAsync()
+	client := NewClient(gotransport.NewTransport(context.Background(), c2, opts).LoopAsync(), service)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var sum int
+	if err := client.Call(ctx, "add", addArgs{A: 1, B: 2}, &sum); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 3 {
+		t.Fatalf("sum = %d, want 3", sum)
+	}
+
+	// a panic is replied as error
+	service.Handle("panic", func(req *Request) (interface{}, error) {
+		panic("boom")
+	})
+	if err := client.Call(ctx, "panic", nil, nil); err == nil || err.Error() != "rpc: panic in panic: boom" {
+		t.Fatalf("err = %v, want the panic", err)
+	}
+
+	err := client.Call(ctx, "sub", addArgs{}, nil)
+	if _, ok := err.(ServerError); !ok || err.Error() != ErrMethodNotFound.Error() {
+		t.Fatalf("err = %v, want %v", err, ErrMethodNotFound)
+	}
+
+	client.Close()
+	if err := client.Call(ctx, "add", addArgs{}, &sum); err == nil {
+		t.Fatal("call on closed transport should fail")
+	}
+}
+
+func TestBusy(t *testing.T) {
+	service := NewService(codec.JSONCodec{})
+	service.SetMaxConcurrent(1)
+	release := make(chan struct{})
+	service.Handle("wait", func(req *Request) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+
+	c1, c2 := net.Pipe()
+	opts := gotransport.MakeOptions()
+	gotransport.WithMessage(service.OnMessage)(opts)
+	t1 := gotransport.NewTransport(context.Background(), c1, opts).LoopAsync()
+	defer t1.Close()
+	client := NewClient(gotransport.NewTransport(context.Background(), c2, opts).LoopAsync(), service)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Call(ctx, "wait", nil, nil)
+	}()
+	for {
+		service.mu.Lock()
+		serving := service.serving
+		service.mu.Unlock()
+		if serving == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	err := client.Call(ctx, "wait", nil, nil)
+	if err == nil || err.Error() != ErrBusy.Error() {
+		t.Fatalf("err = %v, want %v", err, ErrBusy)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// a duplicate reply doesn't block the transport
+	reply := &message{kind: kindResponse, seq: 1}
+	data, _ := reply.marshal()
+	packet := t1.ProtocolMake()
+	packet.SetPayload(data)
+	service.mu.Lock()
+	service.pending[call{transport: t1.ID(), seq: 1}] = make(chan *message, 1)
+	service.mu.Unlock()
+	service.OnMessage(t1, packet)
+	service.OnMessage(t1, packet)
+}
+
+func TestForgedReply(t *testing.T) {
+	service := NewService(codec.JSONCodec{})
+	opts := gotransport.MakeOptions()
+	gotransport.WithMessage(service.OnMessage)(opts)
+
+	// the peer never replies
+	c1, c2 := net.Pipe()
+	t1 := gotransport.NewTransport(context.Background(), c1, opts).LoopAsync()
+	defer t1.Close()
+	t2 := gotransport.NewTransport(context.Background(), c2, nil).LoopAsync()
+	defer t2.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- service.Call(ctx, t1, "add", addArgs{}, nil)
+	}()
+	var seq uint64
+	for {
+		service.mu.Lock()
+		pending := len(service.pending)
+		seq = service.seq
+		service.mu.Unlock()
+		if pending == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// another transport of the service replies with the sequence id
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	other := gotransport.NewTransport(context.Background(), c3, opts)
+	defer other.Close()
+	data, err := (&message{kind: kindResponse, seq: seq}).marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := other.ProtocolMake()
+	packet.SetPayload(data)
+	service.OnMessage(other, packet)
+
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
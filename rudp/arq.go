@@ -0,0 +1,471 @@
+package rudp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrMalformed = errors.New("rudp: malformed segment")
+
+// segment commands
+const (
+	cmdPush byte = iota + 1 // data
+	cmdFin                  // end of the stream, sequenced as data
+	cmdAck                  // selective ack of sn, echoes ts
+	cmdWask                 // asks for the window
+	cmdWins                 // tells the window
+)
+
+// headerSize is the size of the segment header
+//
+//  [ conv (4) ][ cmd (1) ][ wnd (2) ][ una (4) ][ sn (4) ][ ts (4) ][ len (2) ][ data ]
+//
+// where una is the next sn expected by the sender of the segment, so every
+// segment acks all the segments before una, and wnd is its receive window.
+const headerSize = 21
+
+type segment struct {
+	cmd  byte
+	wnd  uint16
+	una  uint32
+	sn   uint32
+	ts   uint32
+	data []byte
+
+	// sender side
+	resendAt uint32
+	rto      uint32
+	xmit     int
+	fastack  int
+}
+
+func (s *segment) encode(b []byte, conv uint32) []byte {
+	var h [headerSize]byte
+	binary.BigEndian.PutUint32(h[0:], conv)
+	h[4] = s.cmd
+	binary.BigEndian.PutUint16(h[5:], s.wnd)
+	binary.BigEndian.PutUint32(h[7:], s.una)
+	binary.BigEndian.PutUint32(h[11:], s.sn)
+	binary.BigEndian.PutUint32(h[15:], s.ts)
+	binary.BigEndian.PutUint16(h[19:], uint16(len(s.data)))
+	b = append(b, h[:]...)
+	return append(b, s.data...)
+}
+
+// decodeConv returns the conv of the first segment of the datagram.
+func decodeConv(datagram []byte) (uint32, bool) {
+	if len(datagram) < headerSize {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(datagram), true
+}
+
+// diff compares the sequence numbers or timestamps across wrapping.
+func diff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+// arq is the state machine of ARQ, with sequence numbers, selective and
+// cumulative acks, retransmission timers with RTT estimation, fast
+// retransmission and a congestion window. It isn't safe for concurrent
+// use, and doesn't do any I/O, output is called with each datagram.
+type arq struct {
+	conv   uint32
+	mtu    int
+	mss    int
+	config *Config
+	output func(datagram []byte)
+
+	// sender
+	sndUna   uint32
+	sndNxt   uint32
+	sndQueue []*segment // not sent yet
+	sndBuf   []*segment // in flight, sorted by sn
+	rmtWnd   int
+	cwnd     float64
+	ssthresh float64
+	probeAt  uint32
+
+	// receiver
+	rcvNxt  uint32
+	rcvBuf  []*segment // out of order, sorted by sn
+	rcvData bytes.Buffer
+	finRecv bool
+	acks    []*segment
+	wndSent int // the window told last
+
+	// rtt
+	srtt   int32
+	rttvar int32
+	rto    uint32
+
+	dead bool
+	buf  []byte
+}
+
+func newARQ(conv uint32, config *Config, output func([]byte)) *arq {
+	return &arq{
+		conv:     conv,
+		mtu:      config.MTU,
+		mss:      config.MTU - headerSize,
+		config:   config,
+		output:   output,
+		rmtWnd:   config.Window,
+		cwnd:     1,
+		ssthresh: float64(config.Window),
+		rto:      initialRTO,
+		wndSent:  config.Window,
+	}
+}
+
+// send queues the data of the stream, a short last segment is
+// filled up first.
+func (a *arq) send(data []byte) {
+	if n := len(a.sndQueue); n > 0 {
+		last := a.sndQueue[n-1]
+		if last.cmd == cmdPush && len(last.data) < a.mss {
+			size := a.mss - len(last.data)
+			if size > len(data) {
+				size = len(data)
+			}
+			last.data = append(last.data, data[:size]...)
+			data = data[size:]
+		}
+	}
+	for len(data) > 0 {
+		size := len(data)
+		if size > a.mss {
+			size = a.mss
+		}
+		a.sndQueue = append(a.sndQueue, &segment{cmd: cmdPush, data: append([]byte(nil), data[:size]...)})
+		data = data[size:]
+	}
+}
+
+// sendFin queues the end of the stream.
+func (a *arq) sendFin() {
+	a.sndQueue = append(a.sndQueue, &segment{cmd: cmdFin})
+}
+
+// waitSend returns the segments not acked yet.
+func (a *arq) waitSend() int {
+	return len(a.sndQueue) + len(a.sndBuf)
+}
+
+// window returns the receive window left.
+func (a *arq) window() int {
+	w := a.config.Window - len(a.rcvBuf) - (a.rcvData.Len()+a.mss-1)/a.mss
+	if w < 0 {
+		return 0
+	}
+	return w
+}
+
+// read reads the data received in order.
+func (a *arq) read(b []byte) int {
+	n, _ := a.rcvData.Read(b)
+	return n
+}
+
+// windowOpened reports whether the window was told closed and is open now.
+func (a *arq) windowOpened() bool {
+	return a.wndSent == 0 && a.window() > 0
+}
+
+// input handles a datagram of segments from the peer.
+func (a *arq) input(datagram []byte, now uint32) error {
+	var (
+		maxAck  uint32
+		acked   bool
+		prevUna = a.sndUna
+	)
+	for len(datagram) > 0 {
+		if len(datagram) < headerSize {
+			return ErrMalformed
+		}
+		if binary.BigEndian.Uint32(datagram) != a.conv {
+			return ErrMalformed
+		}
+		s := &segment{
+			cmd: datagram[4],
+			wnd: binary.BigEndian.Uint16(datagram[5:]),
+			una: binary.BigEndian.Uint32(datagram[7:]),
+			sn:  binary.BigEndian.Uint32(datagram[11:]),
+			ts:  binary.BigEndian.Uint32(datagram[15:]),
+		}
+		size := int(binary.BigEndian.Uint16(datagram[19:]))
+		if len(datagram) < headerSize+size {
+			return ErrMalformed
+		}
+		s.data = datagram[headerSize : headerSize+size]
+		datagram = datagram[headerSize+size:]
+
+		a.rmtWnd = int(s.wnd)
+		a.acknowledge(s.una)
+
+		switch s.cmd {
+		case cmdAck:
+			if diff(now, s.ts) >= 0 {
+				a.updateRTT(diff(now, s.ts))
+			}
+			a.ackSegment(s.sn)
+			if !acked || diff(s.sn, maxAck) > 0 {
+				maxAck, acked = s.sn, true
+			}
+		case cmdPush, cmdFin:
+			if diff(s.sn, a.rcvNxt+uint32(a.config.Window)) >= 0 {
+				// beyond the window
+				continue
+			}
+			a.acks = append(a.acks, &segment{cmd: cmdAck, sn: s.sn, ts: s.ts})
+			if diff(s.sn, a.rcvNxt) >= 0 {
+				s.data = append([]byte(nil), s.data...)
+				a.receive(s)
+			}
+		case cmdWask:
+			a.wndSent = -1 // tell it in the next flush
+		case cmdWins:
+		default:
+			return ErrMalformed
+		}
+	}
+
+	if acked {
+		// the segments before the newest acked one are skipped
+		for _, s := range a.sndBuf {
+			if diff(s.sn, maxAck) < 0 {
+				s.fastack++
+			}
+		}
+	}
+	if diff(a.sndUna, prevUna) > 0 {
+		a.grow(int(a.sndUna - prevUna))
+	}
+	return nil
+}
+
+// acknowledge drops the segments before una, which the peer has.
+func (a *arq) acknowledge(una uint32) {
+	i := 0
+	for i < len(a.sndBuf) && diff(a.sndBuf[i].sn, una) < 0 {
+		i++
+	}
+	if i > 0 {
+		a.sndBuf = append(a.sndBuf[:0], a.sndBuf[i:]...)
+	}
+	a.updateUna()
+}
+
+func (a *arq) ackSegment(sn uint32) {
+	for i, s := range a.sndBuf {
+		if s.sn == sn {
+			a.sndBuf = append(a.sndBuf[:i], a.sndBuf[i+1:]...)
+			break
+		}
+		if diff(s.sn, sn) > 0 {
+			break
+		}
+	}
+	a.updateUna()
+}
+
+func (a *arq) updateUna() {
+	if len(a.sndBuf) > 0 {
+		a.sndUna = a.sndBuf[0].sn
+	} else {
+		a.sndUna = a.sndNxt
+	}
+}
+
+// receive keeps the segment in order, and moves the consecutive ones
+// to the stream.
+func (a *arq) receive(s *segment) {
+	i := len(a.rcvBuf)
+	for i > 0 && diff(a.rcvBuf[i-1].sn, s.sn) >= 0 {
+		if a.rcvBuf[i-1].sn == s.sn {
+			return // duplicate
+		}
+		i--
+	}
+	a.rcvBuf = append(a.rcvBuf, nil)
+	copy(a.rcvBuf[i+1:], a.rcvBuf[i:])
+	a.rcvBuf[i] = s
+
+	n := 0
+	for n < len(a.rcvBuf) && a.rcvBuf[n].sn == a.rcvNxt {
+		s := a.rcvBuf[n]
+		if s.cmd == cmdFin {
+			a.finRecv = true
+		} else {
+			a.rcvData.Write(s.data)
+		}
+		a.rcvNxt++
+		n++
+	}
+	if n > 0 {
+		a.rcvBuf = append(a.rcvBuf[:0], a.rcvBuf[n:]...)
+	}
+}
+
+// updateRTT estimates the rto as RFC 6298.
+func (a *arq) updateRTT(rtt int32) {
+	if a.srtt == 0 {
+		a.srtt = rtt
+		a.rttvar = rtt / 2
+	} else {
+		delta := rtt - a.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		a.rttvar = (3*a.rttvar + delta) / 4
+		a.srtt = (7*a.srtt + rtt) / 8
+		if a.srtt < 1 {
+			a.srtt = 1
+		}
+	}
+	rto := uint32(a.srtt + 4*a.rttvar)
+	if min := uint32(a.config.MinRTO.Milliseconds()); rto < min {
+		rto = min
+	}
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	a.rto = rto
+}
+
+// grow opens the congestion window as segments are acked,
+// by a segment per ack in slow start, by a segment per window after.
+func (a *arq) grow(acked int) {
+	if a.config.NoCongestion {
+		return
+	}
+	for i := 0; i < acked; i++ {
+		if a.cwnd < a.ssthresh {
+			a.cwnd++
+		} else {
+			a.cwnd += 1 / a.cwnd
+		}
+	}
+	if max := float64(a.config.Window); a.cwnd > max {
+		a.cwnd = max
+	}
+}
+
+// sendWindow returns the segments that may be in flight.
+func (a *arq) sendWindow() int {
+	w := a.config.Window
+	if a.rmtWnd < w {
+		w = a.rmtWnd
+	}
+	if !a.config.NoCongestion && int(a.cwnd) < w {
+		w = int(a.cwnd)
+	}
+	if w < 1 && a.rmtWnd > 0 {
+		w = 1
+	}
+	return w
+}
+
+// flush sends the acks, the window, the new segments within the send
+// window, and retransmits the segments timed out or skipped.
+func (a *arq) flush(now uint32) {
+	wnd := a.window()
+	header := segment{wnd: uint16(wnd), una: a.rcvNxt}
+	a.buf = a.buf[:0]
+
+	for _, ack := range a.acks {
+		ack.wnd, ack.una = header.wnd, header.una
+		a.write(ack)
+	}
+	a.acks = a.acks[:0]
+
+	// probe the window of the peer while it is closed
+	if a.rmtWnd == 0 {
+		if a.probeAt == 0 || diff(now, a.probeAt) >= 0 {
+			s := header
+			s.cmd = cmdWask
+			a.write(&s)
+			a.probeAt = now + probeInterval
+		}
+	} else {
+		a.probeAt = 0
+	}
+	if a.wndSent != wnd && (a.wndSent <= 0 || wnd == 0) {
+		s := header
+		s.cmd = cmdWins
+		a.write(&s)
+	}
+	a.wndSent = wnd
+
+	for len(a.sndQueue) > 0 && diff(a.sndNxt, a.sndUna+uint32(a.sendWindow())) < 0 {
+		s := a.sndQueue[0]
+		a.sndQueue = a.sndQueue[1:]
+		s.sn = a.sndNxt
+		a.sndNxt++
+		a.sndBuf = append(a.sndBuf, s)
+	}
+
+	var lost, fast bool
+	for _, s := range a.sndBuf {
+		send := false
+		switch {
+		case s.xmit == 0:
+			send = true
+			s.rto = a.rto
+			s.resendAt = now + s.rto
+		case diff(now, s.resendAt) >= 0:
+			send, lost = true, true
+			s.rto += s.rto / 2
+			if s.rto > maxRTO {
+				s.rto = maxRTO
+			}
+			s.resendAt = now + s.rto
+		case s.fastack >= a.config.FastResend && a.config.FastResend > 0:
+			send, fast = true, true
+			s.fastack = 0
+			s.resendAt = now + s.rto
+		}
+		if !send {
+			continue
+		}
+		s.xmit++
+		s.ts, s.wnd, s.una = now, header.wnd, header.una
+		a.write(s)
+		if s.xmit > a.config.DeadLink {
+			a.dead = true
+		}
+	}
+	if len(a.buf) > 0 {
+		a.output(a.buf)
+		a.buf = a.buf[:0]
+	}
+
+	if a.config.NoCongestion {
+		return
+	}
+	if fast {
+		inflight := float64(a.sndNxt - a.sndUna)
+		a.ssthresh = inflight / 2
+		if a.ssthresh < minSsthresh {
+			a.ssthresh = minSsthresh
+		}
+		a.cwnd = a.ssthresh + float64(a.config.FastResend)
+	}
+	if lost {
+		a.ssthresh = a.cwnd / 2
+		if a.ssthresh < minSsthresh {
+			a.ssthresh = minSsthresh
+		}
+		a.cwnd = 1
+	}
+}
+
+// write appends the segment to the datagram, which is sent when full.
+func (a *arq) write(s *segment) {
+	if len(a.buf)+headerSize+len(s.data) > a.mtu {
+		a.output(a.buf)
+		a.buf = a.buf[:0]
+	}
+	a.buf = s.encode(a.buf, a.conv)
+}
@@ -0,0 +1,416 @@
+package rudp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrBrokenLink = errors.New("rudp: broken link, segment not acked")
+
+const (
+	DefaultMTU        = 1400
+	DefaultWindow     = 128
+	DefaultInterval   = 10 * time.Millisecond
+	DefaultMinRTO     = 50 * time.Millisecond
+	DefaultFastResend = 2
+	DefaultDeadLink   = 20
+	DefaultLinger     = 5 * time.Second
+
+	// Network is the network of the addresses of a Conn.
+	Network = "rudp"
+)
+
+// in milliseconds
+const (
+	initialRTO    = 200
+	maxRTO        = 60000
+	probeInterval = 500
+)
+
+const minSsthresh = 2
+
+// maxDatagramSize is the read buffer size of a socket.
+const maxDatagramSize = 64 * 1024
+
+// Config configures a Conn, the zero value uses the defaults.
+// Both peers should use the same MTU and Window.
+type Config struct {
+	MTU          int           // max datagram size, default DefaultMTU
+	Window       int           // send and receive window in segments, default DefaultWindow
+	Interval     time.Duration // flush interval, default DefaultInterval
+	MinRTO       time.Duration // min retransmission timeout, default DefaultMinRTO
+	FastResend   int           // skips of a segment to retransmit it, default DefaultFastResend, -1 disables it
+	DeadLink     int           // transmissions of a segment to give up, default DefaultDeadLink
+	Linger       time.Duration // max time Close waits for the sent data to be acked, default DefaultLinger
+	NoCongestion bool          // disables the congestion window
+}
+
+func (c *Config) normalize() {
+	if c.MTU <= headerSize || c.MTU > maxDatagramSize {
+		c.MTU = DefaultMTU
+	}
+	if c.Window <= 0 || c.Window > 0xFFFF {
+		c.Window = DefaultWindow
+	}
+	if c.Interval <= 0 {
+		c.Interval = DefaultInterval
+	}
+	if c.MinRTO <= 0 {
+		c.MinRTO = DefaultMinRTO
+	}
+	if c.FastResend == 0 {
+		c.FastResend = DefaultFastResend
+	}
+	if c.DeadLink <= 0 {
+		c.DeadLink = DefaultDeadLink
+	}
+	if c.Linger <= 0 {
+		c.Linger = DefaultLinger
+	}
+}
+
+// Addr is the address of a Conn, its network is Network, so that
+// the Conn is taken for a stream rather than datagrams.
+type Addr struct {
+	net.Addr
+}
+
+func (a *Addr) Network() string {
+	return Network
+}
+
+// Conn is a reliable ordered stream over datagrams, a net.Conn.
+// The data is sent in segments with sequence numbers, which are acked
+// each and cumulatively, retransmitted on timeout or when later ones are
+// acked, and sent within the window of the peer and the congestion window.
+type Conn struct {
+	pc        net.PacketConn
+	remote    net.Addr
+	config    Config
+	start     time.Time
+	onRelease func()
+
+	mu            sync.Mutex
+	arq           *arq
+	err           error
+	closing       bool
+	closeAt       time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+	wake          chan struct{} // closed when the state changes
+
+	flush chan struct{}
+	die   chan struct{}
+	once  sync.Once
+}
+
+// Dial connects to the address on the network "udp", "udp4" or "udp6".
+func Dial(network, address string, config *Config) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return Client(pc, raddr, config)
+}
+
+// Client makes a conn to the remote address over pc, which is dedicated
+// to the conn and closed with it.
+func Client(pc net.PacketConn, remote net.Addr, config *Config) (*Conn, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	c := newConn(pc, remote, binary.BigEndian.Uint32(b[:]), config)
+	c.onRelease = func() {
+		pc.Close()
+	}
+	// the first segment tells the peer about the conn
+	c.arq.sndQueue = append(c.arq.sndQueue, &segment{cmd: cmdPush})
+	go c.run()
+	go c.readLoop()
+	c.signal()
+	return c, nil
+}
+
+func newConn(pc net.PacketConn, remote net.Addr, conv uint32, config *Config) *Conn {
+	c := &Conn{
+		pc:     pc,
+		remote: remote,
+		start:  time.Now(),
+		wake:   make(chan struct{}),
+		flush:  make(chan struct{}, 1),
+		die:    make(chan struct{}),
+	}
+	if config != nil {
+		c.config = *config
+	}
+	c.config.normalize()
+	c.arq = newARQ(conv, &c.config, func(datagram []byte) {
+		pc.WriteTo(datagram, remote)
+	})
+	return c
+}
+
+// now is the clock of the arq in milliseconds.
+func (c *Conn) now() uint32 {
+	return uint32(time.Since(c.start) / time.Millisecond)
+}
+
+// notify wakes the waiting Read and Write, c.mu is held.
+func (c *Conn) notify() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+// signal flushes as soon as possible.
+func (c *Conn) signal() {
+	select {
+	case c.flush <- struct{}{}:
+	default:
+	}
+}
+
+// run flushes every interval until the conn is released.
+func (c *Conn) run() {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.flush:
+		case <-c.die:
+			return
+		}
+		if c.update() {
+			c.release()
+			return
+		}
+	}
+}
+
+// update flushes, and reports whether the conn is done.
+func (c *Conn) update() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.arq.flush(c.now())
+	if c.arq.dead && c.err == nil {
+		c.err = ErrBrokenLink
+		c.notify()
+	}
+	if c.err != nil {
+		return true
+	}
+	// the sent data is acked and the peer closed too, or it's too late
+	return c.closing && ((c.arq.waitSend() == 0 && c.arq.finRecv) || time.Now().After(c.closeAt))
+}
+
+func (c *Conn) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if addr.String() == c.remote.String() {
+			c.input(buf[:n])
+		}
+	}
+}
+
+// input handles a datagram from the peer.
+func (c *Conn) input(datagram []byte) {
+	c.mu.Lock()
+	err := c.arq.input(datagram, c.now())
+	c.notify()
+	c.mu.Unlock()
+	if err == nil {
+		c.signal()
+	}
+}
+
+// fail breaks the conn with the error.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.notify()
+	c.mu.Unlock()
+	c.release()
+}
+
+// release stops the conn, and calls onRelease.
+func (c *Conn) release() {
+	c.once.Do(func() {
+		close(c.die)
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = net.ErrClosed
+		}
+		c.notify()
+		c.mu.Unlock()
+		if c.onRelease != nil {
+			c.onRelease()
+		}
+	})
+}
+
+// wait waits the state to change until the deadline.
+func wait(wake chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-wake:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Read reads the data received in order, it returns io.EOF once the peer
+// closed and the data is read. An empty b never blocks, it probes the
+// state of the conn.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closing {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if c.arq.rcvData.Len() > 0 {
+			n := c.arq.read(b)
+			opened := c.arq.windowOpened()
+			c.mu.Unlock()
+			if opened {
+				c.signal()
+			}
+			return n, nil
+		}
+		if c.arq.finRecv {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		if len(b) == 0 {
+			c.mu.Unlock()
+			return 0, nil
+		}
+		wake, deadline := c.wake, c.readDeadline
+		c.mu.Unlock()
+		if err := wait(wake, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write queues the data, it blocks while the data not acked yet
+// exceeds twice the window.
+func (c *Conn) Write(b []byte) (int, error) {
+	n := 0
+	for {
+		c.mu.Lock()
+		if c.closing {
+			c.mu.Unlock()
+			return n, net.ErrClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return n, err
+		}
+		if room := 2*c.config.Window - c.arq.waitSend(); room > 0 {
+			size := room * c.arq.mss
+			if size > len(b)-n {
+				size = len(b) - n
+			}
+			c.arq.send(b[n : n+size])
+			n += size
+		}
+		if n == len(b) {
+			c.mu.Unlock()
+			c.signal()
+			return n, nil
+		}
+		wake, deadline := c.wake, c.writeDeadline
+		c.mu.Unlock()
+		c.signal()
+		if err := wait(wake, deadline); err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close closes the conn, the data written is still sent and the end of
+// the stream is sent after it, within the Linger.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closing = true
+	c.closeAt = time.Now().Add(c.config.Linger)
+	if c.err == nil {
+		c.arq.sendFin()
+	}
+	c.notify()
+	c.mu.Unlock()
+	c.signal()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return &Addr{c.pc.LocalAddr()}
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return &Addr{c.remote}
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.notify()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.notify()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.notify()
+	c.mu.Unlock()
+	return nil
+}
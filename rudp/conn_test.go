@@ -0,0 +1,156 @@
+package rudp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn drops the datagrams written at the rate.
+type lossyConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	rate float64
+	rand *mrand.Rand
+}
+
+func lossy(pc net.PacketConn, rate float64) net.PacketConn {
+	return &lossyConn{PacketConn: pc, rate: rate, rand: mrand.New(mrand.NewSource(1))}
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.rand.Float64() < c.rate
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// pair returns the conns of a client and server both dropping at the rate.
+func pair(t *testing.T, rate float64) (*Conn, net.Conn, *Listener) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := Server(lossy(pc, rate), nil)
+	cpc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(lossy(cpc, rate), pc.LocalAddr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server, ln
+}
+
+func TestLoss(t *testing.T) {
+	client, server, ln := pair(t, 0.1)
+	defer ln.Close()
+	if client.LocalAddr().Network() != Network {
+		t.Fatalf("network = %s, want %s", client.LocalAddr().Network(), Network)
+	}
+
+	// echo the stream back
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(server, server)
+		copied <- err
+		server.Close()
+	}()
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	go func() {
+		client.Write(data)
+	}()
+	client.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted or reordered")
+	}
+
+	// the end of the stream goes through the loss too
+	client.Close()
+	select {
+	case err := <-copied:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("end of stream lost")
+	}
+}
+
+func TestClose(t *testing.T) {
+	client, server, ln := pair(t, 0)
+	defer ln.Close()
+
+	// an empty read probes the conn without blocking
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Read(nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("empty read: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("empty read blocked")
+	}
+
+	client.Write([]byte("bye"))
+	client.Close()
+	if _, err := client.Read(nil); err != net.ErrClosed {
+		t.Fatalf("empty read after close: %v", err)
+	}
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(server)
+	if err != nil || string(b) != "bye" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+	if _, err := client.Write([]byte("x")); err != net.ErrClosed {
+		t.Fatalf("write after close: %v", err)
+	}
+
+	// both closed, the conns are released
+	server.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ln.mu.Lock()
+		n := len(ln.conns)
+		ln.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("conn not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// deadlines
+	client, server, _ = pair(t, 0)
+	defer client.Close()
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read deadline not exceeded")
+	}
+}
@@ -0,0 +1,163 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAcceptBacklog is the conns waiting to be accepted, the
+	// segments of new conns beyond it are dropped.
+	DefaultAcceptBacklog = 128
+
+	// releasedTimeout is how long the segments of a released conn are
+	// dropped rather than taken for a new conn.
+	releasedTimeout = time.Minute
+)
+
+// Listener accepts the conns of the peers over a socket shared by them,
+// a net.Listener.
+type Listener struct {
+	pc     net.PacketConn
+	config *Config
+
+	mu       sync.Mutex
+	conns    map[string]*Conn
+	released map[string]time.Time
+	accept   chan *Conn
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// Listen announces on the local address on the network "udp", "udp4" or "udp6".
+func Listen(network, address string, config *Config) (*Listener, error) {
+	pc, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return Server(pc, config), nil
+}
+
+// Server makes a listener over pc, which is closed with it.
+func Server(pc net.PacketConn, config *Config) *Listener {
+	l := &Listener{
+		pc:       pc,
+		config:   config,
+		conns:    make(map[string]*Conn),
+		released: make(map[string]time.Time),
+		accept:   make(chan *Conn, DefaultAcceptBacklog),
+		closed:   make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *Listener) readLoop() {
+	defer l.Close()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			l.mu.Lock()
+			conns := l.conns
+			l.conns = make(map[string]*Conn)
+			l.mu.Unlock()
+			for _, c := range conns {
+				c.fail(net.ErrClosed)
+			}
+			return
+		}
+		conv, ok := decodeConv(buf[:n])
+		if !ok {
+			continue
+		}
+		key := addr.String() + "/" + strconv.FormatUint(uint64(conv), 10)
+
+		l.mu.Lock()
+		c, ok := l.conns[key]
+		if !ok {
+			c = l.open(key, addr, conv, buf[:n])
+		}
+		l.mu.Unlock()
+		if c != nil {
+			c.input(buf[:n])
+		}
+	}
+}
+
+// open makes the conn of the first segment of a peer, l.mu is held.
+func (l *Listener) open(key string, addr net.Addr, conv uint32, datagram []byte) *Conn {
+	if _, ok := l.released[key]; ok || !opening(datagram) {
+		return nil
+	}
+	c := newConn(l.pc, addr, conv, l.config)
+	select {
+	case l.accept <- c:
+	default:
+		// the backlog is full, the peer retransmits
+		return nil
+	}
+	c.onRelease = func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.conns[key] == c {
+			delete(l.conns, key)
+		}
+		now := time.Now()
+		for k, at := range l.released {
+			if now.Sub(at) > releasedTimeout {
+				delete(l.released, k)
+			}
+		}
+		l.released[key] = now
+	}
+	l.conns[key] = c
+	go c.run()
+	return c
+}
+
+// opening reports whether the datagram has the first segment of a conn.
+func opening(datagram []byte) bool {
+	for len(datagram) >= headerSize {
+		cmd, sn := datagram[4], binary.BigEndian.Uint32(datagram[11:])
+		if cmd == cmdPush && sn == 0 {
+			return true
+		}
+		size := headerSize + int(binary.BigEndian.Uint16(datagram[19:]))
+		if size > len(datagram) {
+			return false
+		}
+		datagram = datagram[size:]
+	}
+	return false
+}
+
+// Accept waits for the next conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the socket, and so the conns accepted.
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.pc.Close()
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return &Addr{l.pc.LocalAddr()}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/luweimy/gotransport"
+)
+
+// DatagramIdleTimeout is how long a datagram peer lives without sending
+// anything, if Options.IdleTimeout isn't set.
+const DatagramIdleTimeout = 2 * time.Minute
+
+// DefaultMaxPeers is the max remote addresses served at once,
+// if Options.MaxPeers isn't set.
+const DefaultMaxPeers = 4096
+
+// datagramInboxSize is the datagrams kept for a peer not reading,
+// the datagrams beyond it are dropped as the network could do.
+const datagramInboxSize = 64
+
+func isDatagramNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
+
+// datagramLoop reads the datagrams and feeds them to the transports
+// of the remote addresses, a new address makes a new transport.
+func (s *Server) datagramLoop(pc net.PacketConn) error {
+	defer pc.Close()
+	buf := make([]byte, gotransport.MaxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			s.mu.Lock()
+			shutdown := s.shutdown
+			s.mu.Unlock()
+			if shutdown {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		if n == 0 || addr == nil {
+			continue
+		}
+
+		key := addr.String()
+		s.mu.Lock()
+		c, ok := s.peers[key]
+		if !ok && len(s.peers) >= s.maxPeers() {
+			// the datagrams of new peers are dropped, as any source
+			// address may be forged
+			s.mu.Unlock()
+			continue
+		}
+		if !ok {
+			c = newDatagramConn(pc, addr, s.opts.IdleTimeout)
+			c.onClose = func() {
+				s.mu.Lock()
+				if s.peers[key] == c {
+					delete(s.peers, key)
+				}
+				s.mu.Unlock()
+			}
+			s.peers[key] = c
+		}
+		s.mu.Unlock()
+		c.deliver(append([]byte(nil), buf[:n]...))
+		if ok {
+			continue
+		}
+
+		t := gotransport.NewTransport(s.ctx, c, s.transportOptions())
+		if !s.track(t) {
+			t.Close()
+			continue
+		}
+		t.LoopAsync()
+	}
+}
+
+func (s *Server) maxPeers() int {
+	if s.opts.MaxPeers > 0 {
+		return s.opts.MaxPeers
+	}
+	return DefaultMaxPeers
+}
+
+// datagramConn is the virtual conn of a remote address,
+// each Read returns a datagram from it, each Write sends one to it.
+type datagramConn struct {
+	pc      net.PacketConn
+	remote  net.Addr
+	idle    time.Duration
+	inbox   chan []byte
+	onClose func()
+
+	mu       sync.Mutex
+	deadline time.Time
+	wake     chan struct{} // closed when the deadline changes
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newDatagramConn(pc net.PacketConn, remote net.Addr, idle time.Duration) *datagramConn {
+	if idle <= 0 {
+		idle = DatagramIdleTimeout
+	}
+	return &datagramConn{
+		pc:     pc,
+		remote: remote,
+		idle:   idle,
+		inbox:  make(chan []byte, datagramInboxSize),
+		wake:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *datagramConn) deliver(datagram []byte) {
+	select {
+	case c.inbox <- datagram:
+	default:
+	}
+}
+
+// Read returns the next datagram, or gotransport.ErrIdleTimeout if none
+// arrives within the idle timeout, which expires the peer.
+func (c *datagramConn) Read(b []byte) (int, error) {
+	idle := time.NewTimer(c.idle)
+	defer idle.Stop()
+	for {
+		c.mu.Lock()
+		deadline, wake := c.deadline, c.wake
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		var (
+			n   int
+			err error
+		)
+		select {
+		case datagram := <-c.inbox:
+			n = copy(b, datagram)
+		case <-c.closed:
+			err = io.EOF
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-idle.C:
+			err = gotransport.ErrIdleTimeout
+		case <-wake:
+			// the deadline changed
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		return n, err
+	}
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	return c.pc.WriteTo(b, c.remote)
+}
+
+func (c *datagramConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *datagramConn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+func (c *datagramConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *datagramConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *datagramConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline does nothing, the socket is shared by the peers.
+func (c *datagramConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
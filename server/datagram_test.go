@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/luweimy/gotransport"
+	"github.com/luweimy/gotransport/client"
+	"github.com/luweimy/gotransport/rudp"
+)
+
+func TestDatagram(t *testing.T) {
+	server := New(
+		gotransport.WithMessage(func(transport gotransport.Transport, packet gotransport.Protocol) {
+			transport.WritePacket(packet)
+		}),
+		gotransport.WithIdleTimeout(100*time.Millisecond),
+	)
+	go server.Listen("udp", "127.0.0.1:0")
+	defer server.Close()
+	addr := waitDatagramAddr(server)
+
+	received := make(chan string, 4)
+	opts := gotransport.MakeOptions()
+	gotransport.WithMessage(func(transport gotransport.Transport, packet gotransport.Protocol) {
+		received <- string(packet.Payload())
+	})(opts)
+	conn, err := net.Dial("udp", addr.String())
+	errorCheck(err)
+	client := gotransport.NewTransport(context.Background(), conn, opts).LoopAsync()
+	defer client.Close()
+
+	// a packet per datagram
+	for _, s := range []string{"a", "bb", "ccc"} {
+		_, err := client.WriteString(s)
+		errorCheck(err)
+	}
+	for _, want := range []string{"a", "bb", "ccc"} {
+		select {
+		case s := <-received:
+			if s != want {
+				t.Fatalf("received %q, want %q", s, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("datagram lost on loopback")
+		}
+	}
+	if server.Count() != 1 {
+		t.Fatalf("count = %d, want 1", server.Count())
+	}
+
+	// the idle peer expires
+	deadline := time.Now().Add(time.Second)
+	for server.Count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle peer not expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDatagramMaxPeers(t *testing.T) {
+	server := New(
+		gotransport.WithMessage(func(transport gotransport.Transport, packet gotransport.Protocol) {
+			transport.WritePacket(packet)
+		}),
+		gotransport.WithMaxPeers(1),
+	)
+	go server.Listen("udp", "127.0.0.1:0")
+	defer server.Close()
+	addr := waitDatagramAddr(server)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("udp", addr.String())
+		errorCheck(err)
+		// a packet in a datagram
+		p := gotransport.PacketProtocol()
+		p.SetPayload([]byte("hello"))
+		buf := &bytes.Buffer{}
+		_, err = p.WriteTo(buf)
+		errorCheck(err)
+		_, err = conn.Write(buf.Bytes())
+		errorCheck(err)
+		return conn
+	}
+	c1 := dial()
+	defer c1.Close()
+	c1.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c1.Read(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	conn := dial()
+	defer conn.Close()
+
+	// the second peer is dropped
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Fatal("peer beyond the limit served")
+	}
+	if server.Count() != 1 {
+		t.Fatalf("count = %d, want 1", server.Count())
+	}
+}
+
+func waitDatagramAddr(server *Server) net.Addr {
+	for {
+		server.mu.Lock()
+		pc := server.pc
+		server.mu.Unlock()
+		if pc != nil {
+			return pc.LocalAddr()
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRUDP(t *testing.T) {
+	server := New(
+		gotransport.WithMessage(func(transport gotransport.Transport, packet gotransport.Protocol) {
+			transport.WritePacket(packet)
+		}),
+	)
+	go server.Listen("rudp", "127.0.0.1:0")
+	defer server.Close()
+	addr := waitAddr(server)
+	if addr.Network() != rudp.Network {
+		t.Fatalf("network = %s, want %s", addr.Network(), rudp.Network)
+	}
+
+	received := make(chan string, 4)
+	c := client.New(gotransport.WithMessage(func(transport gotransport.Transport, packet gotransport.Protocol) {
+		received <- string(packet.Payload())
+	}))
+	errorCheck(c.Connect("rudp", addr.String()))
+	defer c.Close()
+
+	// packets are framed in the stream, as over tcp
+	for _, s := range []string{"a", "bb", "ccc"} {
+		_, err := c.WriteString(s)
+		errorCheck(err)
+	}
+	for _, want := range []string{"a", "bb", "ccc"} {
+		select {
+		case s := <-received:
+			if s != want {
+				t.Fatalf("received %q, want %q", s, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("packet not echoed")
+		}
+	}
+}
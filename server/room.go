@@ -0,0 +1,104 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/luweimy/gotransport"
+)
+
+// rooms keeps the members of named groups.
+type rooms struct {
+	mu      sync.Mutex
+	members map[string]map[uint64]gotransport.Transport
+	joined  map[uint64]map[string]struct{}
+}
+
+// Join adds the transport to the room, the membership is removed
+// automatically when the transport is closed.
+func (s *Server) Join(t gotransport.Transport, room string) {
+	r := &s.rooms
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t.Context().Err() != nil {
+		return
+	}
+	if r.members == nil {
+		r.members = make(map[string]map[uint64]gotransport.Transport)
+		r.joined = make(map[uint64]map[string]struct{})
+	}
+
+	joined, ok := r.joined[t.ID()]
+	if !ok {
+		joined = make(map[string]struct{})
+		r.joined[t.ID()] = joined
+		go func() {
+			<-t.Context().Done()
+			r.leaveAll(t)
+		}()
+	}
+	joined[room] = struct{}{}
+
+	members, ok := r.members[room]
+	if !ok {
+		members = make(map[uint64]gotransport.Transport)
+		r.members[room] = members
+	}
+	members[t.ID()] = t
+}
+
+// Leave removes the transport from the room.
+func (s *Server) Leave(t gotransport.Transport, room string) {
+	r := &s.rooms
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if joined, ok := r.joined[t.ID()]; ok {
+		delete(joined, room)
+	}
+	r.remove(room, t.ID())
+}
+
+// Publish writes the packet to every member of the room. The packet is
+// encoded once and the same bytes are written to each member.
+// It returns the number of successful writes.
+func (s *Server) Publish(room string, packet gotransport.Protocol) (int, error) {
+	encoded, err := gotransport.Encode(packet)
+	if err != nil {
+		return 0, err
+	}
+
+	r := &s.rooms
+	r.mu.Lock()
+	members := make([]gotransport.Transport, 0, len(r.members[room]))
+	for _, t := range r.members[room] {
+		members = append(members, t)
+	}
+	r.mu.Unlock()
+
+	var n int
+	for _, t := range members {
+		if _, err := t.WritePacket(encoded); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *rooms) leaveAll(t gotransport.Transport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for room := range r.joined[t.ID()] {
+		r.remove(room, t.ID())
+	}
+	delete(r.joined, t.ID())
+}
+
+func (r *rooms) remove(room string, id uint64) {
+	members, ok := r.members[room]
+	if !ok {
+		return
+	}
+	delete(members, id)
+	if len(members) == 0 {
+		delete(r.members, room)
+	}
+}
@@ -9,24 +9,38 @@ import (
 	"time"
 
 	"github.com/luweimy/gotransport"
+	"github.com/luweimy/gotransport/rudp"
 )
 
 var (
 	ErrMultipleListenCalls = errors.New("server multiple listen calls")
+	ErrServerClosed        = errors.New("server: closed")
 )
 
 type Server struct {
 	opts *gotransport.Options
 	ctx  context.Context
 
-	ln net.Listener
-	mu sync.Mutex
+	ln         net.Listener
+	mu         sync.Mutex
+	accepted   map[uint64]gotransport.Transport // live, connected or not
+	transports map[uint64]gotransport.Transport // connected, see register
+	shutdown   bool
+
+	// datagram networks
+	pc    net.PacketConn
+	peers map[string]*datagramConn
+
+	rooms rooms
 }
 
 func New(opts ...gotransport.OptionFunc) *Server {
 	s := &Server{
-		opts: gotransport.MakeOptions(),
-		ctx:  context.Background(),
+		opts:       gotransport.MakeOptions(),
+		ctx:        context.Background(),
+		accepted:   make(map[uint64]gotransport.Transport),
+		transports: make(map[uint64]gotransport.Transport),
+		peers:      make(map[string]*datagramConn),
 	}
 	s.Options(opts...)
 	return s
@@ -40,19 +54,45 @@ func (s *Server) Options(opts ...gotransport.OptionFunc) {
 
 // Listen announces on the local network address.
 //
-// The network must be "tcp", "tcp4", "tcp6", "unix" or "unixpacket".
+// The network must be "tcp", "tcp4", "tcp6", "unix" or "unixpacket",
+// or a datagram network "udp", "udp4", "udp6" or "unixgram", in which case
+// a transport is made for each remote address, its packets are read
+// from a datagram each, and it is closed after the IdleTimeout, or
+// DatagramIdleTimeout, without datagrams. The "unixgram" peers must
+// be bound to their own addresses. The network "rudp" or "kcp" listens
+// on UDP for the reliable streams of package rudp.
 func (s *Server) Listen(network, address string) error {
 	s.mu.Lock()
-	if s.ln != nil {
+	if s.shutdown {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.ln != nil || s.pc != nil {
 		s.mu.Unlock()
 		return ErrMultipleListenCalls
 	}
 
+	if isDatagramNetwork(network) {
+		pc, err := net.ListenPacket(network, address)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.pc = pc
+		s.mu.Unlock()
+		return s.datagramLoop(pc)
+	}
+
 	var (
 		ln  net.Listener
 		err error
 	)
-	if s.opts.ConfigTLS != nil {
+	if network == "rudp" || network == "kcp" {
+		ln, err = rudp.Listen("udp", address, nil)
+		if err == nil && s.opts.ConfigTLS != nil {
+			ln = tls.NewListener(ln, s.opts.ConfigTLS)
+		}
+	} else if s.opts.ConfigTLS != nil {
 		ln, err = tls.Listen(network, address, s.opts.ConfigTLS)
 	} else {
 		ln, err = net.Listen(network, address)
@@ -68,19 +108,186 @@ func (s *Server) Listen(network, address string) error {
 	return s.listenLoop(ln)
 }
 
+// Serve accepts the conns of the listener until it is closed, such as a
+// websocket.Listener served by an http server.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.ln != nil || s.pc != nil {
+		s.mu.Unlock()
+		return ErrMultipleListenCalls
+	}
+	s.ln = ln
+	s.mu.Unlock()
+	return s.listenLoop(ln)
+}
+
 // Addr returns the listener's network address, a *TCPAddr.
 // The Addr returned is shared by all invocations of Addr, so
 // do not modify it.
 func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pc != nil {
+		return s.pc.LocalAddr()
+	}
 	return s.ln.Addr()
 }
 
 // Close stops listening on the TCP address.
-// Already Accepted connections are not closed.
+// Already Accepted connections are not closed, see Shutdown.
+// The datagram transports can't live without the socket, so they
+// stop receiving.
 func (s *Server) Close() error {
+	s.mu.Lock()
+	pc := s.pc
+	s.mu.Unlock()
+	if pc != nil {
+		return pc.Close()
+	}
 	return s.ln.Close()
 }
 
+// Shutdown gracefully shuts down the server: it stops accepting, lets every
+// live transport finish its in-flight message handler, then closes them.
+// Shutdown returns once all transports are gone, or ctx.Err() if the context
+// expires first, in which case the remaining transports are closed forcibly.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	ln, pc := s.ln, s.pc
+	s.mu.Unlock()
+	if pc != nil {
+		// the datagram transports write with the socket until they are gone
+		defer pc.Close()
+	}
+	s.mu.Lock()
+	transports := make([]gotransport.Transport, 0, len(s.accepted))
+	for _, t := range s.accepted {
+		transports = append(transports, t)
+	}
+	s.mu.Unlock()
+
+	if ln != nil {
+		ln.Close()
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, len(transports))
+	)
+	for _, t := range transports {
+		wg.Add(1)
+		go func(t gotransport.Transport) {
+			defer wg.Done()
+			if err := t.Shutdown(ctx); err != nil {
+				errs <- err
+			}
+		}(t)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// Get returns the live transport of the given id. The transports are
+// known once connected, that is, handshaked, authenticated and accepted
+// by OnConnected, so are those of Count, Range and Broadcast.
+func (s *Server) Get(id uint64) (gotransport.Transport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.transports[id]
+	return t, ok
+}
+
+// Count returns the number of live transports.
+func (s *Server) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.transports)
+}
+
+// Range calls fn sequentially for each live transport.
+// If fn returns false, range stops the iteration.
+func (s *Server) Range(fn func(t gotransport.Transport) bool) {
+	for _, t := range s.snapshot() {
+		if !fn(t) {
+			return
+		}
+	}
+}
+
+// Broadcast writes the packet to every live transport accepted by filter,
+// a nil filter accepts all. It returns the number of successful writes.
+func (s *Server) Broadcast(packet gotransport.Protocol, filter func(t gotransport.Transport) bool) int {
+	var n int
+	for _, t := range s.snapshot() {
+		if filter != nil && !filter(t) {
+			continue
+		}
+		if _, err := t.WritePacket(packet); err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// snapshot copies the live transports, so callbacks run without the lock.
+func (s *Server) snapshot() []gotransport.Transport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transports := make([]gotransport.Transport, 0, len(s.transports))
+	for _, t := range s.transports {
+		transports = append(transports, t)
+	}
+	return transports
+}
+
+// track keeps the transport until it is closed.
+func (s *Server) track(t gotransport.Transport) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return false
+	}
+	s.accepted[t.ID()] = t
+	go func() {
+		<-t.Context().Done()
+		s.mu.Lock()
+		delete(s.accepted, t.ID())
+		delete(s.transports, t.ID())
+		s.mu.Unlock()
+	}()
+	return true
+}
+
+// register adds the connected transport to the registry.
+func (s *Server) register(t gotransport.Transport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accepted[t.ID()]; ok && t.Context().Err() == nil {
+		s.transports[t.ID()] = t
+	}
+}
+
+// transportOptions copies the options of the server, whose OnConnected
+// registers the transport once the user's one accepts it.
+func (s *Server) transportOptions() *gotransport.Options {
+	opts := *s.opts
+	onConnected := opts.OnConnected
+	opts.OnConnected = func(t gotransport.Transport) bool {
+		if onConnected != nil && !onConnected(t) {
+			return false
+		}
+		s.register(t)
+		return true
+	}
+	return &opts
+}
+
 func (s *Server) listenLoop(ln net.Listener) error {
 	defer func() {
 		ln.Close()
@@ -89,6 +296,12 @@ func (s *Server) listenLoop(ln net.Listener) error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			s.mu.Lock()
+			shutdown := s.shutdown
+			s.mu.Unlock()
+			if shutdown {
+				return ErrServerClosed
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if delay == 0 {
 					delay = 5 * time.Millisecond
@@ -109,6 +322,11 @@ func (s *Server) listenLoop(ln net.Listener) error {
 		}
 		delay = 0
 
-		gotransport.NewTransport(s.ctx, conn, s.opts).LoopAsync()
+		t := gotransport.NewTransport(s.ctx, conn, s.transportOptions())
+		if !s.track(t) {
+			t.Close()
+			return ErrServerClosed
+		}
+		t.LoopAsync()
 	}
 }
@@ -1,10 +1,19 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/luweimy/gotransport"
+	"github.com/luweimy/gotransport/client"
+	"github.com/luweimy/gotransport/websocket"
 )
 
 func errorCheck(err error) {
@@ -44,3 +53,228 @@ func TestServer(t *testing.T) {
 	err := server.Listen("tcp", "127.0.0.1:9090")
 	errorCheck(err)
 }
+
+func TestShutdown(t *testing.T) {
+	var handled int32
+	server := New(gotransport.WithMessage(func(transport gotransport.Transport, packet gotransport.Protocol) {
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&handled, 1)
+	}))
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- server.Listen("tcp", "127.0.0.1:0")
+	}()
+	addr := waitAddr(server)
+
+	conn, err := net.Dial("tcp", addr.String())
+	errorCheck(err)
+	defer conn.Close()
+	p := gotransport.PacketProtocol()
+	p.SetPayload([]byte("hello"))
+	_, err = p.WriteTo(conn)
+	errorCheck(err)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	errorCheck(server.Shutdown(ctx))
+	if atomic.LoadInt32(&handled) != 1 {
+		t.Fatal("shutdown returned before the handler finished")
+	}
+	if err := <-listenErr; err != ErrServerClosed {
+		t.Fatalf("listen err = %v, want %v", err, ErrServerClosed)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection should be closed")
+	}
+}
+
+func waitAddr(server *Server) net.Addr {
+	for {
+		server.mu.Lock()
+		ln := server.ln
+		server.mu.Unlock()
+		if ln != nil {
+			return ln.Addr()
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	connected := make(chan uint64, 2)
+	server := New(gotransport.WithConnected(func(transport gotransport.Transport) bool {
+		connected <- transport.ID()
+		return true
+	}))
+	go server.Listen("tcp", "127.0.0.1:0")
+	defer server.Close()
+	addr := waitAddr(server)
+
+	conns := make([]net.Conn, 2)
+	for i := range conns {
+		conn, err := net.Dial("tcp", addr.String())
+		errorCheck(err)
+		defer conn.Close()
+		conns[i] = conn
+	}
+	id1, id2 := <-connected, <-connected
+	// registered once OnConnected returns
+	for server.Count() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	p := gotransport.PacketProtocol()
+	p.SetPayload([]byte("hello"))
+	if n := server.Broadcast(p, nil); n != 2 {
+		t.Fatalf("broadcast = %d, want 2", n)
+	}
+	for _, conn := range conns {
+		p := gotransport.PacketProtocol()
+		_, err := p.ReadFrom(conn)
+		errorCheck(err)
+		if string(p.Payload()) != "hello" {
+			t.Fatalf("payload = %q, want hello", p.Payload())
+		}
+	}
+
+	first, ok := server.Get(id1)
+	if !ok {
+		t.Fatal("transport not registered")
+	}
+	first.Close()
+	for server.Count() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := server.Get(id1); ok {
+		t.Fatal("closed transport still registered")
+	}
+	if _, ok := server.Get(id2); !ok {
+		t.Fatal("live transport not registered")
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	server := New(gotransport.WithAuth(gotransport.TokenAuth(func(token []byte) (interface{}, error) {
+		if string(token) != "ok" {
+			return nil, errors.New("bad token")
+		}
+		return "user", nil
+	}), time.Second))
+	go server.Listen("tcp", "127.0.0.1:0")
+	defer server.Close()
+	addr := waitAddr(server)
+
+	authed, err := net.Dial("tcp", addr.String())
+	errorCheck(err)
+	defer authed.Close()
+	token := gotransport.PacketProtocol()
+	token.SetPayload([]byte("ok"))
+	_, err = token.WriteTo(authed)
+	errorCheck(err)
+	for server.Count() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// still authenticating while broadcasting
+	pending, err := net.Dial("tcp", addr.String())
+	errorCheck(err)
+	defer pending.Close()
+	time.Sleep(20 * time.Millisecond)
+	if server.Count() != 1 {
+		t.Fatalf("count = %d, want 1", server.Count())
+	}
+	p := gotransport.PacketProtocol()
+	p.SetPayload([]byte("secret"))
+	if n := server.Broadcast(p, nil); n != 1 {
+		t.Fatalf("broadcast = %d, want 1", n)
+	}
+	received := gotransport.PacketProtocol()
+	_, err = received.ReadFrom(authed)
+	errorCheck(err)
+	if string(received.Payload()) != "secret" {
+		t.Fatalf("payload = %q, want secret", received.Payload())
+	}
+	pending.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := pending.Read(make([]byte, 16)); err == nil {
+		t.Fatal("broadcast to a peer not authenticated")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	server := New()
+	server.Options(gotransport.WithConnected(func(transport gotransport.Transport) bool {
+		server.Join(transport, "news")
+		return true
+	}))
+	go server.Listen("tcp", "127.0.0.1:0")
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", waitAddr(server).String())
+	errorCheck(err)
+	for server.Count() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	p := gotransport.PacketProtocol()
+	p.SetPayload([]byte("hello"))
+	n, err := server.Publish("news", p)
+	errorCheck(err)
+	if n != 1 {
+		t.Fatalf("publish = %d, want 1", n)
+	}
+	if n, _ := server.Publish("sports", p); n != 0 {
+		t.Fatalf("publish to empty room = %d, want 0", n)
+	}
+	_, err = p.ReadFrom(conn)
+	errorCheck(err)
+	if string(p.Payload()) != "hello" {
+		t.Fatalf("payload = %q, want hello", p.Payload())
+	}
+
+	conn.Close()
+	for server.Count() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for {
+		server.rooms.mu.Lock()
+		members := len(server.rooms.members["news"])
+		server.rooms.mu.Unlock()
+		if members == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	server := New(gotransport.WithMessage(func(transport gotransport.Transport, packet gotransport.Protocol) {
+		transport.WritePacket(packet)
+	}))
+	ln := websocket.NewListener(nil)
+	ts := httptest.NewServer(ln)
+	defer ts.Close()
+	go server.Serve(ln)
+	defer server.Close()
+
+	received := make(chan string, 1)
+	c := client.New(gotransport.WithMessage(func(transport gotransport.Transport, packet gotransport.Protocol) {
+		received <- string(packet.Payload())
+	}))
+	errorCheck(c.Connect("ws", strings.TrimPrefix(ts.URL, "http://")))
+	defer c.Close()
+
+	_, err := c.WriteString("hello")
+	errorCheck(err)
+	select {
+	case s := <-received:
+		if s != "hello" {
+			t.Fatalf("received %q, want hello", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet not echoed")
+	}
+	if server.Count() != 1 {
+		t.Fatalf("count = %d, want 1", server.Count())
+	}
+}
@@ -0,0 +1,229 @@
+package gotransport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrStreamNotSupport = errors.New("stream: protocol doesn't support control frames")
+	ErrStreamClosed     = errors.New("stream: closed")
+	ErrStreamReset      = errors.New("stream: reset by peer")
+	ErrStreamBroken     = errors.New("stream: chunk out of sequence")
+)
+
+const (
+	// StreamChunkSize is the max data size of a chunk frame.
+	StreamChunkSize = 32 * 1024
+	// MaxStreams is the default max streams handled at once.
+	MaxStreams = 256
+)
+
+// chunk flags
+const (
+	streamData byte = iota
+	streamEnd
+	streamReset
+)
+
+// OpenStream opens a stream to the peer, the data written is split into
+// chunk frames of up to StreamChunkSize, so a large payload is never
+// held whole in memory, and a write blocks while the send queue is full.
+// Close ends the stream; CloseWithError, if the writer has it, aborts it
+// and the peer reads ErrStreamReset.
+//
+// The chunks are control frames carrying
+//
+//  [ stream id (uvarint) ][ sequence (uvarint) ][ flag (1) ][ data ]
+//
+// so the protocol must implement ControlProtocol, and the peer must
+// handle streams with OnStream.
+func (t *transport) OpenStream() (io.WriteCloser, error) {
+	if _, ok := t.ProtocolMake().(ControlProtocol); !ok {
+		return nil, ErrStreamNotSupport
+	}
+	return &streamWriter{t: t, id: atomic.AddUint64(&t.streamID, 1)}, nil
+}
+
+type streamWriter struct {
+	t      *transport
+	id     uint64
+	mu     sync.Mutex
+	seq    uint64
+	closed bool
+}
+
+func (w *streamWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrStreamClosed
+	}
+	for len(p) > 0 {
+		size := len(p)
+		if size > StreamChunkSize {
+			size = StreamChunkSize
+		}
+		if err := w.send(streamData, p[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+func (w *streamWriter) Close() error {
+	return w.end(streamEnd)
+}
+
+// CloseWithError aborts the stream, the peer reads ErrStreamReset.
+func (w *streamWriter) CloseWithError(err error) error {
+	return w.end(streamReset)
+}
+
+func (w *streamWriter) end(flag byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.send(flag, nil)
+}
+
+func (w *streamWriter) send(flag byte, data []byte) error {
+	var buf [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], w.id)
+	n += binary.PutUvarint(buf[n:], w.seq)
+	payload := make([]byte, 0, n+1+len(data))
+	payload = append(payload, buf[:n]...)
+	payload = append(payload, flag)
+	payload = append(payload, data...)
+	w.seq++
+
+	packet := w.t.ProtocolMake()
+	packet.(ControlProtocol).SetControl(ControlStream)
+	packet.SetPayload(payload)
+	_, err := w.t.enqueue(w.t.ctx, packet)
+	return err
+}
+
+// streamReader is the receiving end of a stream.
+type streamReader struct {
+	pw  *io.PipeWriter
+	seq uint64
+}
+
+// handleStream feeds the chunk to the stream reader, it reports whether
+// the packet was a chunk and is consumed. The first chunk starts OnStream
+// in a goroutine; the next chunks block until the handler reads them,
+// which pauses the reading of the transport. The chunks of a stream whose
+// handler returned are dropped, as are the ones of a stream beyond
+// Options.MaxStreams, which is reset without calling OnStream.
+// handleStream runs in the read loop only.
+func (t *transport) handleStream(packet Protocol) (bool, error) {
+	if t.opts.OnStream == nil {
+		return false, nil
+	}
+	cp, ok := packet.(ControlProtocol)
+	if !ok {
+		return false, nil
+	}
+	if kind, ok := cp.Control(); !ok || kind != ControlStream {
+		return false, nil
+	}
+
+	payload := packet.Payload()
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return true, ErrStreamBroken
+	}
+	payload = payload[n:]
+	seq, n := binary.Uvarint(payload)
+	if n <= 0 || len(payload) <= n {
+		return true, ErrStreamBroken
+	}
+	flag, data := payload[n], payload[n+1:]
+
+	t.streamsMu.Lock()
+	s, ok := t.streams[id]
+	if !ok {
+		if seq != 0 {
+			t.streamsMu.Unlock()
+			// the ids are increasing, a lower one is of a stream reset
+			if id <= t.streamsLast {
+				return true, nil
+			}
+			return true, ErrStreamBroken
+		}
+		if id > t.streamsLast {
+			t.streamsLast = id
+		}
+		if t.streamsActive >= t.maxStreams() {
+			// not tracked, the next chunks are dropped by id
+			t.streamsMu.Unlock()
+			return true, nil
+		}
+		if t.streams == nil {
+			t.streams = make(map[uint64]*streamReader)
+		}
+		pr, pw := io.Pipe()
+		s = &streamReader{pw: pw}
+		t.streams[id] = s
+		t.streamsActive++
+		t.handlers.Add(1)
+		go func() {
+			defer t.handlers.Done()
+			t.opts.OnStream(t, pr)
+			pr.CloseWithError(ErrStreamClosed)
+			t.streamsMu.Lock()
+			t.streamsActive--
+			t.streamsMu.Unlock()
+		}()
+	}
+	if flag != streamData {
+		delete(t.streams, id)
+	}
+	t.streamsMu.Unlock()
+	if seq != s.seq {
+		return true, ErrStreamBroken
+	}
+	s.seq++
+
+	switch flag {
+	case streamData:
+		if len(data) > 0 {
+			s.pw.Write(data)
+		}
+	case streamEnd:
+		s.pw.Close()
+	default:
+		s.pw.CloseWithError(ErrStreamReset)
+	}
+	return true, nil
+}
+
+func (t *transport) maxStreams() int {
+	if t.opts.MaxStreams > 0 {
+		return t.opts.MaxStreams
+	}
+	return MaxStreams
+}
+
+// closeStreams aborts the streams still open, which also unblocks
+// the reading stuck in a chunk.
+func (t *transport) closeStreams(err error) {
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	t.streamsMu.Lock()
+	defer t.streamsMu.Unlock()
+	for id, s := range t.streams {
+		s.pw.CloseWithError(err)
+		delete(t.streams, id)
+	}
+}
@@ -0,0 +1,172 @@
+package gotransport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, 2)
+	opts := MakeOptions()
+	WithStream(func(transport Transport, stream io.Reader) {
+		data, err := ioutil.ReadAll(stream)
+		results <- result{data, err}
+	})(opts)
+	WithMaxPacketSize(64 * 1024)(opts)
+
+	c1, c2 := net.Pipe()
+	t1 := NewTransport(context.Background(), c1, opts).LoopAsync()
+	defer t1.Close()
+	NewTransport(context.Background(), c2, opts).LoopAsync()
+
+	// larger than the max packet size
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+	w, err := t1.OpenStream()
+	assertErr(err)
+	_, err = io.Copy(w, bytes.NewReader(data))
+	assertErr(err)
+	assertErr(w.Close())
+
+	// aborted
+	w2, err := t1.OpenStream()
+	assertErr(err)
+	w2.Write([]byte("partial"))
+	w2.(interface{ CloseWithError(error) error }).CloseWithError(nil)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if r.err == nil {
+				assert(bytes.Equal(r.data, data))
+			} else {
+				assert(r.err == ErrStreamReset)
+				assert(string(r.data) == "partial")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("stream not received")
+		}
+	}
+
+	c3, c4 := net.Pipe()
+	defer c3.Close()
+	defer c4.Close()
+	_, err = NewTransport(context.Background(), c3, &Options{Factory: LineProtocol}).OpenStream()
+	assert(err == ErrStreamNotSupport)
+}
+
+func TestStreamLimit(t *testing.T) {
+	results := make(chan string, 3)
+	release := make(chan struct{})
+	opts := MakeOptions()
+	WithStream(func(transport Transport, stream io.Reader) {
+		data, _ := ioutil.ReadAll(stream)
+		results <- string(data)
+		if string(data) == "a" {
+			<-release
+		}
+	})(opts)
+	WithMaxStreams(1)(opts)
+
+	c1, c2 := net.Pipe()
+	t1 := NewTransport(context.Background(), c1, nil).LoopAsync()
+	defer t1.Close()
+	t2 := NewTransport(context.Background(), c2, opts).LoopAsync()
+
+	send := func(s string) {
+		w, err := t1.OpenStream()
+		assertErr(err)
+		_, err = w.Write([]byte(s))
+		assertErr(err)
+		assertErr(w.Close())
+	}
+	receive := func() string {
+		select {
+		case s := <-results:
+			return s
+		case <-time.After(100 * time.Millisecond):
+			return ""
+		}
+	}
+
+	// the second stream is beyond the limit while the first is handled
+	send("a")
+	assert(receive() == "a")
+	send("b")
+	assert(receive() == "")
+
+	// the streams reset aren't kept
+	for i := 0; i < 100; i++ {
+		w, err := t1.OpenStream()
+		assertErr(err)
+		w.Write([]byte("x"))
+		w.Write([]byte("y"))
+	}
+	send("d")
+	assert(receive() == "")
+	t2.streamsMu.Lock()
+	streams := len(t2.streams)
+	t2.streamsMu.Unlock()
+	assert(streams == 0)
+
+	close(release)
+	for deadline := time.Now().Add(time.Second); ; {
+		t2.streamsMu.Lock()
+		active := t2.streamsActive
+		t2.streamsMu.Unlock()
+		if active == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream handler not released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	send("c")
+	assert(receive() == "c")
+}
+
+func TestStreamShutdown(t *testing.T) {
+	started := make(chan struct{})
+	result := make(chan error, 1)
+	opts := MakeOptions()
+	WithStream(func(transport Transport, stream io.Reader) {
+		close(started)
+		_, err := ioutil.ReadAll(stream)
+		result <- err
+	})(opts)
+
+	c1, c2 := net.Pipe()
+	t1 := NewTransport(context.Background(), c1, nil).LoopAsync()
+	defer t1.Close()
+	t2 := NewTransport(context.Background(), c2, opts).LoopAsync()
+
+	// the stream is left open
+	w, err := t1.OpenStream()
+	assertErr(err)
+	_, err = w.Write([]byte("hello"))
+	assertErr(err)
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		done <- t2.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-done:
+		assertErr(err)
+	case <-time.After(time.Second):
+		t.Fatal("shutdown waits for the open stream")
+	}
+	assert(<-result == ErrShutdown)
+}
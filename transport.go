@@ -2,28 +2,70 @@ package gotransport
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	BufferSize = 1024
+	BufferSize    = 1024
+	SendQueueSize = 128
+
+	// MaxDatagramSize is the max size of a datagram read
+	MaxDatagramSize = 64 * 1024
+)
+
+var (
+	ErrShutdown = errors.New("transport: shutdown")
+	ErrClosed   = errors.New("transport: closed")
+	ErrRejected = errors.New("transport: rejected by OnConnected")
 )
 
+var transportID uint64
+
 // Transport representing a network connection
 type Transport interface {
+	// ID returns the process-wide unique id of the transport.
+	ID() uint64
+
 	// Write writes data to the connection.
-	// Write can be made to time out and return an Error with Timeout() == true
-	// after a fixed time limit; see SetDeadline and SetWriteDeadline.
+	// The packet is encoded at once and queued to the writer goroutine, so
+	// writes are safe for concurrent use, n is the length of the encoded frame.
+	// When the send queue is full the write blocks, fails or closes the
+	// transport depending on the QueuePolicy, see WithSendQueue.
+	// A failed or timed out socket write closes the transport; see WithWriteTimeout.
 	Write(b []byte) (n int, err error)
 	WriteString(s string) (n int, err error)
 	WritePacket(packet Protocol) (n int, err error)
 
+	// WritePacketContext is like WritePacket, but gives up waiting for
+	// the send queue when ctx is done.
+	WritePacketContext(ctx context.Context, packet Protocol) (n int, err error)
+
+	// Send encodes the message with the MessageCodec and writes it,
+	// see WithMessageCodec.
+	Send(msg interface{}) error
+
 	// Close closes the connection.
 	// Any blocked Read or Write operations will be unblocked and return errors.
 	Close() error
 	IsClosed() bool
 
+	// CloseWithError closes the connection, err is reported as the reason
+	// through Done, Err and the OnClosing handler.
+	CloseWithError(err error) error
+
+	// Shutdown stops reading, waits for the in-flight message handlers to
+	// return, then closes the transport with ErrShutdown. The streams still
+	// open are aborted, their handlers read ErrShutdown.
+	// If ctx expires first the transport is closed with ctx.Err().
+	Shutdown(ctx context.Context) error
+
 	// Peer returns the remote network address.
 	Peer() net.Addr
 
@@ -32,8 +74,61 @@ type Transport interface {
 
 	ProtocolMake() Protocol
 
-	// Notify close, the error is the reason of transport close
+	// Notify close, the error is the reason of transport close.
+	// The reason is delivered once, after that the channel is closed,
+	// so any number of goroutines may wait on it.
 	Done() <-chan error
+
+	// Context returns the transport context, which is canceled
+	// when the transport is closed.
+	Context() context.Context
+
+	// Err returns the reason of transport close, it is nil
+	// until the transport is closed.
+	Err() error
+
+	// Negotiated returns the result of the handshake, nil if there
+	// is no handshake, see WithHandshake.
+	Negotiated() *Negotiation
+
+	// Identity returns the identity of the peer given by the
+	// Authenticator, see WithAuth.
+	Identity() interface{}
+
+	// Set, Get and Delete access the session data of the transport,
+	// which lives as long as the transport. They are safe for concurrent use.
+	Set(key string, value interface{})
+	Get(key string) (value interface{}, ok bool)
+	Delete(key string)
+
+	// OpenStream opens a stream of chunk frames to the peer,
+	// which reads it in OnStream, see WithStream.
+	OpenStream() (io.WriteCloser, error)
+}
+
+// IsDatagram reports whether the conn keeps message boundaries, such as
+// "udp" and "unixgram" conns, or conns whose address is a DatagramAddr.
+// The transport reads a packet per datagram and writes each packet as a
+// datagram, so MaxPacketSize should be set below the datagram size of
+// the network.
+func IsDatagram(conn net.Conn) bool {
+	if addr := conn.LocalAddr(); addr != nil {
+		switch addr.Network() {
+		case "udp", "udp4", "udp6", "unixgram":
+			return true
+		}
+		if addr, ok := addr.(DatagramAddr); ok {
+			return addr.Datagram()
+		}
+	}
+	return false
+}
+
+// DatagramAddr is the address of a conn of another network that may keep
+// message boundaries, such as the message mode of package websocket.
+type DatagramAddr interface {
+	net.Addr
+	Datagram() bool
 }
 
 // TransportHijacker hijack transport net.Conn
@@ -42,12 +137,60 @@ type TransportHijacker interface {
 }
 
 type transport struct {
-	ctx  context.Context
-	opts *Options
-	conn net.Conn
+	id       uint64
+	ctx      context.Context
+	cancel   context.CancelFunc
+	opts     *Options
+	conn     net.Conn
+	reader   *bufio.Reader
+	datagram bool // a packet per datagram, see IsDatagram
+
+	looping  int32
+	draining int32
+
+	// handshake
+	ready         chan struct{}
+	handshakeOnce sync.Once
+	handshakeErr  error
+	negotiation   *Negotiation
+	maxPacketSize int64
+
+	// auth and session data
+	identity  interface{}
+	sessionMu sync.RWMutex
+	session   map[string]interface{}
+
+	// send queue
+	sendMu     chan struct{}
+	sendCh     chan []byte
+	closing    chan struct{}
+	writerDone chan struct{}
+
+	// flow control
+	flow            bool
+	creditMu        sync.Mutex
+	credits         int64 // credits granted by the peer, negative if owed
+	consumedCredits int64 // credits consumed but not granted back
+	authenticating  int32 // the writes don't wait for credits
+	granted         chan struct{}
+
+	// message dispatch
+	onMessage  MessageHandler
+	dispatchCh chan Protocol
+	handlers   sync.WaitGroup
+
+	// streams
+	streamID      uint64
+	streamsMu     sync.Mutex
+	streams       map[uint64]*streamReader
+	streamsActive int    // handlers of OnStream running
+	streamsLast   uint64 // highest id of the streams of the peer
 
 	// Done chan
-	doneCh chan error
+	doneCh    chan error
+	closeOnce sync.Once
+	closeErr  error
+	reason    error
 }
 
 func NewTransport(ctx context.Context, conn net.Conn, opts *Options) *transport {
@@ -55,22 +198,43 @@ func NewTransport(ctx context.Context, conn net.Conn, opts *Options) *transport
 		opts = MakeOptions()
 	}
 	t := &transport{
-		ctx:  ctx,
+		id:   atomic.AddUint64(&transportID, 1),
 		opts: opts,
 		conn: conn,
 
-		doneCh: make(chan error, 1),
+		doneCh:        make(chan error, 1),
+		ready:         make(chan struct{}),
+		maxPacketSize: int64(opts.MaxPacketSize),
 	}
+	if opts.Handshake == nil {
+		close(t.ready)
+	}
+	t.flow = t.flowControl()
+	t.granted = make(chan struct{})
+	t.ctx, t.cancel = context.WithCancel(ctx)
 	for _, hook := range opts.Hooks {
 		t.conn = hook(t.conn)
 	}
+	buffSize := BufferSize
+	if opts.BufferSize > 0 {
+		buffSize = opts.BufferSize
+	}
+	if t.datagram = IsDatagram(t.conn); t.datagram {
+		buffSize = MaxDatagramSize
+	}
+	t.reader = bufio.NewReaderSize(t.conn, buffSize)
+	t.startWriter()
 	return t
 }
 
+func (t *transport) ID() uint64 {
+	return t.id
+}
+
 func (t *transport) Write(b []byte) (n int, err error) {
 	packet := t.ProtocolMake()
 	packet.SetPayload(b)
-	return packet.WriteTo(t.conn)
+	return t.WritePacket(packet)
 }
 
 func (t *transport) WriteString(s string) (n int, err error) {
@@ -78,17 +242,46 @@ func (t *transport) WriteString(s string) (n int, err error) {
 }
 
 func (t *transport) WritePacket(packet Protocol) (n int, err error) {
-	return packet.WriteTo(t.conn)
+	return t.WritePacketContext(context.Background(), packet)
 }
 
 func (t *transport) Close() error {
 	return t.close(nil)
 }
 
+func (t *transport) CloseWithError(err error) error {
+	return t.close(err)
+}
+
+func (t *transport) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&t.draining, 1)
+	if atomic.LoadInt32(&t.looping) == 0 {
+		t.close(ErrShutdown)
+		return nil
+	}
+	// unblock the reading, readLoop exits after the handler in flight,
+	// the streams can't be fed anymore, so they are aborted
+	t.conn.SetReadDeadline(time.Now())
+	t.closeStreams(ErrShutdown)
+
+	select {
+	case <-t.ctx.Done():
+		t.close(ErrShutdown)
+		return nil
+	case <-ctx.Done():
+		t.close(ctx.Err())
+		return ctx.Err()
+	}
+}
+
 func (t *transport) IsClosed() bool {
 	if t.conn == nil {
 		return true
 	}
+	if t.datagram {
+		// reading would take a datagram away
+		return t.ctx.Err() != nil
+	}
 	_, err := t.conn.Read([]byte{})
 	return IsClosedConnError(err)
 }
@@ -105,46 +298,123 @@ func (t *transport) Done() <-chan error {
 	return t.doneCh
 }
 
+func (t *transport) Context() context.Context {
+	return t.ctx
+}
+
+func (t *transport) Err() error {
+	select {
+	case <-t.ctx.Done():
+		return t.reason
+	default:
+		return nil
+	}
+}
+
+func (t *transport) Identity() interface{} {
+	return t.identity
+}
+
+func (t *transport) Set(key string, value interface{}) {
+	t.sessionMu.Lock()
+	defer t.sessionMu.Unlock()
+	if t.session == nil {
+		t.session = make(map[string]interface{})
+	}
+	t.session[key] = value
+}
+
+func (t *transport) Get(key string) (value interface{}, ok bool) {
+	t.sessionMu.RLock()
+	defer t.sessionMu.RUnlock()
+	value, ok = t.session[key]
+	return
+}
+
+func (t *transport) Delete(key string) {
+	t.sessionMu.Lock()
+	defer t.sessionMu.Unlock()
+	delete(t.session, key)
+}
+
 func (t *transport) Hijack() net.Conn {
 	return t.conn
 }
 
 func (t *transport) ProtocolMake() Protocol {
-	return t.opts.Factory()
+	packet := t.opts.Factory()
+	if size := atomic.LoadInt64(&t.maxPacketSize); size > 0 {
+		if l, ok := packet.(SizeLimiter); ok {
+			l.SetMaxSize(int(size))
+		}
+	}
+	if b, ok := packet.(TransportBinder); ok {
+		b.BindTransport(t)
+	}
+	return packet
 }
 
 func (t *transport) LoopSync() *transport {
-	if t.opts.OnConnected != nil && !t.opts.OnConnected(t) {
-		t.conn.Close()
-		return t
+	if t.connect() {
+		t.readLoop()
 	}
-	t.readLoop()
 	return t
 }
 
+// LoopAsync reads in a goroutine, OnConnected is called before it
+// returns, unless the handshake or authentication is yet to be done.
 func (t *transport) LoopAsync() *transport {
-	if t.opts.OnConnected != nil && !t.opts.OnConnected(t) {
-		t.conn.Close()
+	if !t.handshaken() || t.opts.Authenticator != nil {
+		go func() {
+			if t.connect() {
+				t.readLoop()
+			}
+		}()
 		return t
 	}
-	go t.readLoop()
+	if t.connect() {
+		go t.readLoop()
+	}
 	return t
 }
 
+// connect runs the handshake, authentication and OnConnected,
+// it returns false if the transport is rejected.
+func (t *transport) connect() bool {
+	if t.Handshake() != nil {
+		return false
+	}
+	// the peer may write while authenticating
+	if t.flow {
+		t.grantCredits(int64(t.opts.FlowControl.Window))
+	}
+	if err := t.authenticate(); err != nil {
+		t.reject(err)
+		return false
+	}
+	if t.opts.OnConnected != nil && !t.opts.OnConnected(t) {
+		t.reject(ErrRejected)
+		return false
+	}
+	return true
+}
+
 func (t *transport) readLoop() {
+	atomic.StoreInt32(&t.looping, 1)
 	var readErr error
+	t.startDispatch()
 	defer func() {
-		if err := recover(); err != nil {
-			readErr = errorWrap(err)
+		t.stopDispatch()
+		if readErr == ErrShutdown {
+			t.closeStreams(ErrShutdown)
+			t.handlers.Wait()
 		}
 		t.close(readErr)
 	}()
 
-	buffSize := BufferSize
-	if t.opts.BufferSize > 0 {
-		buffSize = t.opts.BufferSize
+	if t.opts.Heartbeat != nil && t.opts.Heartbeat.Interval > 0 {
+		go t.heartbeatLoop()
 	}
-	reader := bufio.NewReaderSize(t.conn, buffSize)
 	for {
 		select {
 		case <-t.ctx.Done():
@@ -152,30 +422,160 @@ func (t *transport) readLoop() {
 			return
 		default:
 		}
-		packet := t.ProtocolMake()
-		_, readErr = packet.ReadFrom(reader)
-		if readErr != nil {
+		var packet Protocol
+		if packet, readErr = t.readPacket(t.reader); readErr != nil {
+			if atomic.LoadInt32(&t.draining) == 1 {
+				readErr = ErrShutdown
+			}
+			return
+		}
+		if t.handleHeartbeat(packet) || t.handleCredit(packet) {
+			continue
+		}
+		var consumed bool
+		if consumed, readErr = t.handleStream(packet); readErr != nil {
+			return
+		}
+		if consumed {
+			continue
+		}
+		if readErr = t.dispatch(packet); readErr != nil {
 			return
 		}
-		t.notify(packet)
 	}
 }
 
-func (t *transport) close(err error) error {
-	if t.opts.OnClosing != nil {
-		t.opts.OnClosing(t, err)
+// waitReadable blocks until the next frame begins to arrive, or fails with
+// ErrIdleTimeout if nothing arrives in time, then arms the ReadTimeout for
+// reading the rest of the frame.
+func (t *transport) waitReadable(reader *bufio.Reader) error {
+	idle := t.idleTimeout()
+	if idle <= 0 && t.opts.ReadTimeout <= 0 {
+		return nil
+	}
+
+	// the deadlines may race with Shutdown, so the draining flag
+	// is checked after each of them is set
+	var deadline time.Time
+	if idle > 0 {
+		deadline = time.Now().Add(idle)
+	}
+	t.conn.SetReadDeadline(deadline)
+	if atomic.LoadInt32(&t.draining) == 1 {
+		return ErrShutdown
+	}
+	if _, err := reader.Peek(1); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return ErrIdleTimeout
+		}
+		return err
+	}
+
+	deadline = time.Time{}
+	if t.opts.ReadTimeout > 0 {
+		deadline = time.Now().Add(t.opts.ReadTimeout)
 	}
-	t.doneCh <- err
-	// close the conn
-	closeErr := t.conn.Close()
-	if t.opts.OnClosed != nil {
-		t.opts.OnClosed(t, closeErr)
+	t.conn.SetReadDeadline(deadline)
+	if atomic.LoadInt32(&t.draining) == 1 {
+		return ErrShutdown
 	}
-	return closeErr
+	return nil
 }
 
+// idleTimeout returns the smaller one of IdleTimeout and heartbeat timeout.
+func (t *transport) idleTimeout() time.Duration {
+	idle := t.opts.IdleTimeout
+	if h := t.heartbeatTimeout(); h > 0 && (idle <= 0 || h < idle) {
+		idle = h
+	}
+	return idle
+}
+
+func (t *transport) readPacket(reader *bufio.Reader) (Protocol, error) {
+	if atomic.LoadInt32(&t.draining) == 1 {
+		return nil, ErrShutdown
+	}
+	if err := t.waitReadable(reader); err != nil {
+		return nil, err
+	}
+	return t.next(reader)
+}
+
+// next decodes the next packet, which is a whole datagram if the
+// conn is a datagram one, the bytes of it left over are dropped.
+func (t *transport) next(reader *bufio.Reader) (Protocol, error) {
+	if !t.datagram {
+		return t.decode(reader)
+	}
+	// the buffer is empty, and filled with one datagram
+	if _, err := reader.Peek(1); err != nil {
+		return nil, err
+	}
+	datagram := make([]byte, reader.Buffered())
+	reader.Read(datagram)
+	return t.decode(bytes.NewReader(datagram))
+}
+
+// decode reads a packet, a panic of the protocol is returned as error.
+func (t *transport) decode(reader io.Reader) (packet Protocol, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			packet, err = nil, errorWrap(v)
+		}
+	}()
+	packet = t.ProtocolMake()
+	if _, err = packet.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// close is safe to call multiple times, only the first call takes effect.
+func (t *transport) close(err error) error {
+	t.closeOnce.Do(func() {
+		t.reason = err
+		if t.opts.OnClosing != nil {
+			t.opts.OnClosing(t, err)
+		}
+		t.stopWriter()
+		t.closeStreams(err)
+		t.doneCh <- err
+		close(t.doneCh)
+		t.cancel()
+		// close the conn
+		t.closeErr = t.conn.Close()
+		if t.opts.OnClosed != nil {
+			t.opts.OnClosed(t, t.closeErr)
+		}
+	})
+	return t.closeErr
+}
+
+// reject closes the transport refused by the handshake or OnConnected,
+// the close handlers are not called.
+func (t *transport) reject(err error) {
+	t.closeOnce.Do(func() {
+		t.reason = err
+		if err != nil {
+			t.doneCh <- err
+		}
+		close(t.doneCh)
+		t.cancel()
+		t.closeErr = t.conn.Close()
+		t.stopWriter()
+	})
+}
+
+// notify calls OnMessage, a panic the middlewares didn't recover closes
+// the transport, so the options without Recovery can't crash the process.
 func (t *transport) notify(packet Protocol) {
-	if t.opts.OnMessage != nil {
-		t.opts.OnMessage(t, packet)
+	if t.onMessage == nil {
+		return
 	}
+	defer func() {
+		if v := recover(); v != nil {
+			t.CloseWithError(errorWrap(v))
+		}
+	}()
+	t.onMessage(t, packet)
 }
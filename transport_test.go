@@ -0,0 +1,268 @@
+package gotransport
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fillQueue writes to a transport whose peer never reads until a write fails.
+func fillQueue(t1 Transport, ctx context.Context) error {
+	for i := 0; i < 10; i++ {
+		packet := t1.ProtocolMake()
+		packet.SetPayload([]byte("hello"))
+		if _, err := t1.WritePacketContext(ctx, packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSendQueue(t *testing.T) {
+	for _, policy := range []QueuePolicy{QueueBlock, QueueDrop, QueueClose} {
+		opts := MakeOptions()
+		WithSendQueue(1, policy)(opts)
+		c1, c2 := net.Pipe()
+		t1 := NewTransport(context.Background(), c1, opts)
+
+		// nobody reads the other end, the queue fills up
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := fillQueue(t1, ctx)
+		cancel()
+		switch policy {
+		case QueueBlock:
+			assert(err == context.DeadlineExceeded)
+		case QueueDrop:
+			assert(err == ErrQueueFull)
+			assert(t1.Err() == nil)
+		case QueueClose:
+			assert(err == ErrQueueFull)
+			assert(t1.Err() == ErrQueueFull)
+		}
+		c2.Close()
+		t1.Close()
+	}
+}
+
+func TestConcurrentWrite(t *testing.T) {
+	const writers, count = 8, 100
+	received := make(chan []byte, writers*count)
+	opts := MakeOptions()
+	WithMessage(func(transport Transport, packet Protocol) {
+		received <- packet.Payload()
+	})(opts)
+
+	c1, c2 := net.Pipe()
+	t1 := NewTransport(context.Background(), c1, nil)
+	defer t1.Close()
+	NewTransport(context.Background(), c2, opts).LoopAsync()
+
+	payload := bytes.Repeat([]byte("x"), 1000)
+	for i := 0; i < writers; i++ {
+		go func() {
+			for j := 0; j < count; j++ {
+				t1.Write(payload)
+			}
+		}()
+	}
+	for i := 0; i < writers*count; i++ {
+		select {
+		case p := <-received:
+			assert(bytes.Equal(p, payload))
+		case <-time.After(time.Second):
+			t.Fatal("frames lost or corrupted")
+		}
+	}
+}
+
+func TestWriteWhileClosing(t *testing.T) {
+	// every write reported as successful reaches the peer
+	for i := 0; i < 20; i++ {
+		var received int64
+		opts := MakeOptions()
+		WithMessage(func(transport Transport, packet Protocol) {
+			atomic.AddInt64(&received, 1)
+		})(opts)
+
+		c1, c2 := net.Pipe()
+		t1 := NewTransport(context.Background(), c1, nil)
+		t2 := NewTransport(context.Background(), c2, opts).LoopAsync()
+
+		var written int64
+		done := make(chan struct{})
+		for j := 0; j < 4; j++ {
+			go func() {
+				defer func() { done <- struct{}{} }()
+				for {
+					if _, err := t1.WriteString("hello"); err != nil {
+						return
+					}
+					atomic.AddInt64(&written, 1)
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		t1.Close()
+		for j := 0; j < 4; j++ {
+			<-done
+		}
+		<-t2.Done()
+		assert(atomic.LoadInt64(&received) == atomic.LoadInt64(&written))
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	opts := MakeOptions()
+	WithReadTimeout(50 * time.Millisecond)(opts)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	t1 := NewTransport(context.Background(), c1, opts).LoopAsync()
+
+	// an incomplete header, then nothing more
+	go c2.Write([]byte{1, 0})
+	select {
+	case err := <-t1.Done():
+		ne, ok := err.(net.Error)
+		assert(ok && ne.Timeout())
+	case <-time.After(time.Second):
+		t.Fatal("transport not closed by read timeout")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	const count = 20
+	pool := NewWorkerPool(2, 1)
+	defer pool.Close()
+
+	for _, opt := range []OptionFunc{WithDispatch(DispatchOrdered, 4), WithWorkerPool(pool)} {
+		var (
+			running, peak int32
+			received      = make(chan byte, count)
+		)
+		opts := MakeOptions()
+		opt(opts)
+		WithMessage(func(transport Transport, packet Protocol) {
+			if n := atomic.AddInt32(&running, 1); n > atomic.LoadInt32(&peak) {
+				atomic.StoreInt32(&peak, n)
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			received <- packet.Payload()[0]
+		})(opts)
+
+		c1, c2 := net.Pipe()
+		t1 := NewTransport(context.Background(), c1, nil)
+		NewTransport(context.Background(), c2, opts).LoopAsync()
+		for i := 0; i < count; i++ {
+			t1.Write([]byte{byte(i)})
+		}
+		for i := 0; i < count; i++ {
+			b := <-received
+			if opts.DispatchMode == DispatchOrdered {
+				assert(b == byte(i))
+			}
+		}
+		if opts.DispatchMode == DispatchOrdered {
+			assert(peak == 1)
+		} else {
+			assert(peak <= 2)
+		}
+		t1.Close()
+	}
+
+	// without a pool the default one is used, the handlers run at once
+	opts := MakeOptions()
+	WithDispatch(DispatchPool, 0)(opts)
+	second := make(chan struct{})
+	done := make(chan struct{})
+	WithMessage(func(transport Transport, packet Protocol) {
+		if packet.Payload()[0] == 1 {
+			close(second)
+			return
+		}
+		select {
+		case <-second:
+			close(done)
+		case <-time.After(time.Second):
+		}
+	})(opts)
+	c1, c2 := net.Pipe()
+	t1 := NewTransport(context.Background(), c1, nil)
+	defer t1.Close()
+	NewTransport(context.Background(), c2, opts).LoopAsync()
+	t1.Write([]byte{0})
+	t1.Write([]byte{1})
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handlers not run by the default pool")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var trace []string
+	mark := func(name string) Middleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(transport Transport, packet Protocol) {
+				trace = append(trace, name)
+				next(transport, packet)
+			}
+		}
+	}
+	opts := MakeOptions()
+	WithMiddleware(mark("a"), mark("b"))(opts)
+	WithMessage(func(transport Transport, packet Protocol) {
+		trace = append(trace, "handler")
+		panic("boom")
+	})(opts)
+
+	var written []byte
+	writeOpts := MakeOptions()
+	WithWriteInterceptor(func(next WriteHandler) WriteHandler {
+		return func(transport Transport, packet Protocol) (int, error) {
+			written = packet.Payload()
+			return next(transport, packet)
+		}
+	})(writeOpts)
+
+	c1, c2 := net.Pipe()
+	t1 := NewTransport(context.Background(), c1, writeOpts)
+	t2 := NewTransport(context.Background(), c2, opts).LoopAsync()
+	t1.WriteString("hello")
+
+	select {
+	case err := <-t2.Done():
+		assert(err != nil && err.Error() == "boom")
+	case <-time.After(time.Second):
+		t.Fatal("panic did not close the transport")
+	}
+	assert(strings.Join(trace, ",") == "a,b,handler")
+	assert(string(written) == "hello")
+	t1.Close()
+}
+
+func TestRecoverWithoutMiddleware(t *testing.T) {
+	// options without the Recovery middleware
+	opts := &Options{Factory: PacketProtocol}
+	WithMessage(func(transport Transport, packet Protocol) {
+		panic("boom")
+	})(opts)
+
+	c1, c2 := net.Pipe()
+	t1 := NewTransport(context.Background(), c1, MakeOptions())
+	t2 := NewTransport(context.Background(), c2, opts).LoopAsync()
+	defer t1.Close()
+	t1.WriteString("hello")
+
+	select {
+	case err := <-t2.Done():
+		assert(err != nil && err.Error() == "boom")
+	case <-time.After(time.Second):
+		t.Fatal("panic did not close the transport")
+	}
+}
@@ -0,0 +1,526 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/luweimy/gotransport"
+)
+
+var (
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	ErrPingTimeout  = errors.New("websocket: ping timeout")
+)
+
+// close codes, see RFC 6455 section 7.4.1
+const (
+	CloseNormal             = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatus           = 1005 // never sent, no code in the close frame
+	CloseAbnormal           = 1006 // never sent, closed without a close frame
+	CloseInvalidPayload     = 1007
+	ClosePolicyViolation    = 1008
+	CloseTooBig             = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalError      = 1011
+)
+
+const (
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	// Network is the network of the addresses of a Conn.
+	Network = "websocket"
+)
+
+// opcodes
+const (
+	opContinuation byte = 0
+	opText         byte = 1
+	opBinary       byte = 2
+	opClose        byte = 8
+	opPing         byte = 9
+	opPong         byte = 10
+)
+
+const (
+	// max payload size of a control frame
+	maxControlSize = 125
+	// max time to send the close frame
+	closeTimeout = time.Second
+)
+
+// Config configures a Conn, the zero value uses the defaults.
+type Config struct {
+	// Message reads and writes a packet per binary message, rather than a
+	// stream of the packets in the messages, see gotransport.IsDatagram.
+	// The client takes the mode of a server of this package.
+	Message bool
+
+	// Text writes text messages rather than binary ones, in message mode,
+	// e.g. for the browsers to read strings. The data must be UTF-8.
+	Text bool
+
+	// MaxMessageSize is the max size of a message read in message mode,
+	// default gotransport.MaxDatagramSize, the peer sending a larger one,
+	// or one larger than the buffer of Read, is closed with CloseTooBig.
+	MaxMessageSize int
+
+	// PingInterval pings the peer, which is closed if nothing is read
+	// from it within two intervals, zero doesn't ping.
+	PingInterval time.Duration
+
+	// HandshakeTimeout is the max time of the handshake of the client,
+	// default DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
+	// CheckOrigin reports whether the server accepts the request, by
+	// default the Origin header, if any, must be of the requested host.
+	CheckOrigin func(r *http.Request) bool
+
+	// Header is added to the request of the client.
+	Header http.Header
+
+	// TLS configures the client of "wss" urls.
+	TLS *tls.Config
+}
+
+func (c *Config) normalize() {
+	if c.MaxMessageSize <= 0 {
+		c.MaxMessageSize = gotransport.MaxDatagramSize
+	}
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+}
+
+// CloseError is the close frame from the peer, or sent to it
+// on a protocol error.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+// Addr is the address of a Conn, its network is Network, and it is
+// a gotransport.DatagramAddr telling the mode of the Conn.
+type Addr struct {
+	net.Addr
+	message bool
+}
+
+func (a *Addr) Network() string {
+	return Network
+}
+
+func (a *Addr) String() string {
+	if a.Addr == nil {
+		return Network
+	}
+	return a.Addr.String()
+}
+
+func (a *Addr) Datagram() bool {
+	return a.message
+}
+
+// Conn is a websocket, a net.Conn. Write sends a message, Read reads
+// the data of the binary messages as a stream, or a message each in
+// message mode. The pings are answered while reading.
+type Conn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	client  bool // masks the frames written
+	message bool
+	config  Config
+
+	// the frame read, used by Read only
+	opcode    byte // of the message
+	inMessage bool // more frames of the message follow
+	final     bool
+	remaining int64
+	masked    bool
+	maskKey   [4]byte
+	maskPos   int
+	err       error
+
+	writeMu   sync.Mutex
+	closeSent bool
+
+	lastRead int64 // unix nano
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client, message bool, config Config) *Conn {
+	c := &Conn{
+		conn:     conn,
+		br:       br,
+		client:   client,
+		message:  message,
+		config:   config,
+		lastRead: time.Now().UnixNano(),
+		done:     make(chan struct{}),
+	}
+	if config.PingInterval > 0 {
+		go c.ping()
+	}
+	return c
+}
+
+// ping pings the peer every interval until it is silent for two.
+func (c *Conn) ping() {
+	ticker := time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+		silent := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+		if silent > 2*c.config.PingInterval {
+			c.CloseWithCode(ClosePolicyViolation, ErrPingTimeout.Error())
+			return
+		}
+		c.writeFrame(opPing, nil)
+	}
+}
+
+// Read reads the data of the binary messages, or a message in message
+// mode, which must fit in b. It returns io.EOF once the peer closed
+// normally, or the CloseError. Any error is returned by the next reads
+// too, including a timeout, which may leave a frame partly read.
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		select {
+		case <-c.done:
+			return 0, net.ErrClosed
+		default:
+			return 0, nil
+		}
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	var (
+		n   int
+		err error
+	)
+	if c.message {
+		n, err = c.readMessage(b)
+	} else {
+		n, err = c.readStream(b)
+	}
+	c.err = err
+	return n, err
+}
+
+func (c *Conn) readStream(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+		if c.opcode != opBinary {
+			return 0, c.fail(CloseUnsupportedData, "text message in stream mode")
+		}
+	}
+	return c.readPayload(b)
+}
+
+func (c *Conn) readMessage(b []byte) (int, error) {
+	for {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+		var n, size int64
+		for {
+			if size += c.remaining; size > int64(c.config.MaxMessageSize) {
+				return 0, c.fail(CloseTooBig, "message too big")
+			}
+			if size > int64(len(b)) {
+				return 0, c.fail(CloseTooBig, "message larger than the read buffer")
+			}
+			for c.remaining > 0 {
+				m, err := c.readPayload(b[n:])
+				if err != nil {
+					return 0, err
+				}
+				n += int64(m)
+			}
+			if c.final {
+				break
+			}
+			if err := c.nextFrame(); err != nil {
+				return 0, err
+			}
+		}
+		if c.opcode == opText && !utf8.Valid(b[:n]) {
+			return 0, c.fail(CloseInvalidPayload, "invalid utf-8")
+		}
+		// an empty message isn't a packet
+		if size > 0 {
+			return int(n), nil
+		}
+	}
+}
+
+// nextFrame reads the frames up to the next data one,
+// answering the control ones.
+func (c *Conn) nextFrame() error {
+	for {
+		op, err := c.readHeader()
+		if err != nil {
+			return err
+		}
+		if op >= opClose {
+			if err := c.control(op); err != nil {
+				return err
+			}
+			continue
+		}
+		switch {
+		case op == opContinuation && !c.inMessage:
+			return c.fail(CloseProtocolError, "continuation without a message")
+		case op != opContinuation && c.inMessage:
+			return c.fail(CloseProtocolError, "message not finished")
+		case op != opContinuation && op != opText && op != opBinary:
+			return c.fail(CloseProtocolError, "unknown opcode")
+		}
+		if op != opContinuation {
+			c.opcode = op
+		}
+		c.inMessage = !c.final
+		return nil
+	}
+}
+
+// readHeader reads the header of a frame
+//
+//  [ fin (1 bit) ][ rsv (3 bits) ][ opcode (4 bits) ][ mask (1 bit) ][ length (7 bits, 16 or 64 bits) ][ mask key (0 or 4) ]
+//
+// and sets the frame read.
+func (c *Conn) readHeader() (byte, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(c.br, h[:2]); err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	if h[0]&0x70 != 0 {
+		return 0, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	op := h[0] & 0x0F
+	c.final = h[0]&0x80 != 0
+	c.masked = h[1]&0x80 != 0
+	c.remaining = int64(h[1] & 0x7F)
+	switch c.remaining {
+	case 126:
+		if _, err := io.ReadFull(c.br, h[:2]); err != nil {
+			return 0, err
+		}
+		c.remaining = int64(binary.BigEndian.Uint16(h[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.br, h[:8]); err != nil {
+			return 0, err
+		}
+		if c.remaining = int64(binary.BigEndian.Uint64(h[:8])); c.remaining < 0 {
+			return 0, c.fail(CloseProtocolError, "bad length")
+		}
+	}
+	// only the frames of the clients are masked
+	if c.masked == c.client {
+		return 0, c.fail(CloseProtocolError, "bad mask")
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.br, c.maskKey[:]); err != nil {
+			return 0, err
+		}
+		c.maskPos = 0
+	}
+	if op >= opClose && (!c.final || c.remaining > maxControlSize) {
+		return 0, c.fail(CloseProtocolError, "bad control frame")
+	}
+	return op, nil
+}
+
+func (c *Conn) readPayload(b []byte) (int, error) {
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	if c.masked {
+		for i := range b[:n] {
+			b[i] ^= c.maskKey[(c.maskPos+i)&3]
+		}
+		c.maskPos += n
+	}
+	c.remaining -= int64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// control handles a control frame.
+func (c *Conn) control(op byte) error {
+	payload := make([]byte, c.remaining)
+	for n := 0; n < len(payload); {
+		m, err := c.readPayload(payload[n:])
+		if err != nil {
+			return err
+		}
+		n += m
+	}
+	switch op {
+	case opPing:
+		c.writeFrame(opPong, payload)
+	case opPong:
+	case opClose:
+		code, reason := CloseNoStatus, ""
+		switch {
+		case len(payload) == 1:
+			return c.fail(CloseProtocolError, "bad close frame")
+		case len(payload) >= 2:
+			code, reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+		}
+		// echo the close
+		echo := code
+		if echo == CloseNoStatus {
+			echo = CloseNormal
+		}
+		c.writeClose(echo, "")
+		if code == CloseNormal || code == CloseGoingAway || code == CloseNoStatus {
+			return io.EOF
+		}
+		return &CloseError{Code: code, Reason: reason}
+	default:
+		return c.fail(CloseProtocolError, "unknown opcode")
+	}
+	return nil
+}
+
+// fail sends the close of a protocol error, and returns it.
+func (c *Conn) fail(code int, reason string) error {
+	c.writeClose(code, reason)
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// Write writes b as a message.
+func (c *Conn) Write(b []byte) (int, error) {
+	op := opBinary
+	if c.config.Text {
+		op = opText
+	}
+	if err := c.writeFrame(op, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = 0x80 | op
+	var mask byte
+	if c.client {
+		mask = 0x80
+	}
+	switch n := len(payload); {
+	case n <= maxControlSize:
+		frame[1] = mask | byte(n)
+	case n <= 0xFFFF:
+		frame[1] = mask | 126
+		frame = append(frame, byte(n>>8), byte(n))
+	default:
+		frame[1] = mask | 127
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(n))
+		frame = append(frame, size[:]...)
+	}
+	if c.client {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		frame = append(frame, key[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= key[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *Conn) writeClose(code int, reason string) error {
+	if len(reason) > maxControlSize-2 {
+		reason = reason[:maxControlSize-2]
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return c.writeFrame(opClose, append(payload, reason...))
+}
+
+// Close closes the conn with CloseNormal.
+func (c *Conn) Close() error {
+	return c.CloseWithCode(CloseNormal, "")
+}
+
+// CloseWithCode sends the close frame with the code and reason,
+// then closes the conn.
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		c.writeClose(code, reason)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return &Addr{Addr: c.conn.LocalAddr(), message: c.message}
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return &Addr{Addr: c.conn.RemoteAddr(), message: c.message}
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
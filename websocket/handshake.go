@@ -0,0 +1,215 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// acceptGUID is appended to the key of the client, see RFC 6455 section 1.3.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// the subprotocols telling the mode of a server of this package
+const (
+	protocolStream  = "gotransport.stream"
+	protocolMessage = "gotransport.message"
+)
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains reports whether the comma separated values of the
+// header contain the token, case insensitively.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin is the default CheckOrigin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// Upgrade upgrades the request to a websocket of the server, or replies
+// with the http error and returns ErrBadHandshake.
+func Upgrade(w http.ResponseWriter, r *http.Request, config *Config) (*Conn, error) {
+	var cfg Config
+	if config != nil {
+		cfg = *config
+	}
+	cfg.normalize()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "websocket: method not allowed", http.StatusMethodNotAllowed)
+		return nil, ErrBadHandshake
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket: not a websocket handshake", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "websocket: unsupported version", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		http.Error(w, "websocket: bad key", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	checkOrigin := cfg.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "websocket: origin not allowed", http.StatusForbidden)
+		return nil, ErrBadHandshake
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket: can't hijack the connection", http.StatusInternalServerError)
+		return nil, ErrBadHandshake
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// the deadlines of the http server
+	conn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	// tell a client of this package the mode
+	protocol := protocolStream
+	if cfg.Message {
+		protocol = protocolMessage
+	}
+	if headerContains(r.Header, "Sec-WebSocket-Protocol", protocol) {
+		response += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	conn.SetWriteDeadline(time.Now().Add(cfg.HandshakeTimeout))
+	rw.WriteString(response + "\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return newConn(conn, rw.Reader, false, cfg.Message, cfg), nil
+}
+
+// Dial connects to the "ws" or "wss" url, the mode is the one of the
+// server if it is of this package, or Config.Message.
+func Dial(rawurl string, config *Config) (*Conn, error) {
+	var cfg Config
+	if config != nil {
+		cfg = *config
+	}
+	cfg.normalize()
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	var port string
+	switch u.Scheme {
+	case "ws":
+		port = "80"
+	case "wss":
+		port = "443"
+	default:
+		return nil, ErrBadHandshake
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.HandshakeTimeout}
+	var conn net.Conn
+	if u.Scheme == "wss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, cfg.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(cfg.HandshakeTimeout))
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, v := range cfg.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if cfg.Message {
+		req.Header.Set("Sec-WebSocket-Protocol", protocolMessage+", "+protocolStream)
+	} else {
+		req.Header.Set("Sec-WebSocket-Protocol", protocolStream+", "+protocolMessage)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContains(resp.Header, "Upgrade", "websocket") ||
+		!headerContains(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, ErrBadHandshake
+	}
+	message := cfg.Message
+	switch resp.Header.Get("Sec-WebSocket-Protocol") {
+	case protocolStream:
+		message = false
+	case protocolMessage:
+		message = true
+	}
+	conn.SetDeadline(time.Time{})
+	return newConn(conn, br, true, message, cfg), nil
+}
@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// DefaultAcceptBacklog is the conns waiting to be accepted,
+// the requests beyond it wait.
+const DefaultAcceptBacklog = 128
+
+// Listener is an http.Handler upgrading the requests, and a net.Listener
+// accepting their conns, e.g. for server.Server.Serve.
+type Listener struct {
+	config *Config
+	accept chan *Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func NewListener(config *Config) *Listener {
+	return &Listener{
+		config: config,
+		accept: make(chan *Conn, DefaultAcceptBacklog),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.closed:
+		http.Error(w, "websocket: listener closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	c, err := Upgrade(w, r, l.config)
+	if err != nil {
+		return
+	}
+	select {
+	case l.accept <- c:
+	case <-l.closed:
+		c.CloseWithCode(CloseGoingAway, "")
+	}
+}
+
+// Accept waits for the next conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting, the http server is left serving.
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr returns an address of Network, the address of the
+// http server isn't known.
+func (l *Listener) Addr() net.Addr {
+	return &Addr{message: l.config != nil && l.config.Message}
+}
@@ -0,0 +1,186 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luweimy/gotransport"
+)
+
+// serve serves the echo transports of the listener.
+func serve(t *testing.T, config *Config, opts ...gotransport.OptionFunc) string {
+	ln := NewListener(config)
+	ts := httptest.NewServer(ln)
+	t.Cleanup(ts.Close)
+	t.Cleanup(func() { ln.Close() })
+
+	o := gotransport.MakeOptions()
+	gotransport.WithMessage(func(transport gotransport.Transport, packet gotransport.Protocol) {
+		transport.WritePacket(packet)
+	})(o)
+	for _, opt := range opts {
+		opt(o)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			gotransport.NewTransport(context.Background(), conn, o).LoopAsync()
+		}
+	}()
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func TestStream(t *testing.T) {
+	url := serve(t, nil)
+
+	received := make(chan string, 4)
+	opts := gotransport.MakeOptions()
+	gotransport.WithMessage(func(transport gotransport.Transport, packet gotransport.Protocol) {
+		received <- string(packet.Payload())
+	})(opts)
+	conn, err := Dial(url, &Config{Message: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server tells the mode
+	if gotransport.IsDatagram(conn) {
+		t.Fatal("message mode with a stream server")
+	}
+	client := gotransport.NewTransport(context.Background(), conn, opts).LoopAsync()
+	defer client.Close()
+
+	for _, s := range []string{"a", "bb", "ccc"} {
+		if _, err := client.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"a", "bb", "ccc"} {
+		select {
+		case s := <-received:
+			if s != want {
+				t.Fatalf("received %q, want %q", s, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("packet not echoed")
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	url := serve(t, &Config{Message: true, PingInterval: 20 * time.Millisecond},
+		gotransport.WithProtocol(gotransport.RawProtocol))
+
+	// a raw message each, as from a browser
+	conn, err := Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !gotransport.IsDatagram(conn) {
+		t.Fatal("stream mode with a message server")
+	}
+	for _, s := range []string{"hello", "world"} {
+		if _, err := conn.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 64)
+	for _, want := range []string{"hello", "world"} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Fatalf("read %q, want %q", buf[:n], want)
+		}
+	}
+
+	// the pings are answered while reading, so the server keeps the conn
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Write([]byte("still"))
+	}()
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "still" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+
+	// a message larger than the buffer isn't truncated
+	if _, err := conn.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(buf); !isTooBig(err) {
+		t.Fatalf("read %v, want CloseTooBig", err)
+	}
+}
+
+func isTooBig(err error) bool {
+	ce, ok := err.(*CloseError)
+	return ok && ce.Code == CloseTooBig
+}
+
+func TestReadTimeout(t *testing.T) {
+	url := serve(t, nil)
+	conn, err := Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a timeout may leave a frame partly read, so it is fatal
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := conn.Read(buf); !isTimeout(err) {
+		t.Fatalf("read %v, want a timeout", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn.Write([]byte("hello"))
+	if _, err := conn.Read(buf); !isTimeout(err) {
+		t.Fatalf("read %v, want the timeout again", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	te, ok := err.(interface{ Timeout() bool })
+	return ok && te.Timeout()
+}
+
+func TestClose(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c.Read(make([]byte, 16))
+		c.CloseWithCode(ClosePolicyViolation, "bye")
+	}))
+	defer ts.Close()
+
+	// not a websocket request
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	conn, err := Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hi"))
+	_, err = conn.Read(make([]byte, 16))
+	ce, ok := err.(*CloseError)
+	if !ok || ce.Code != ClosePolicyViolation || ce.Reason != "bye" {
+		t.Fatalf("read %v, want the close of the server", err)
+	}
+}
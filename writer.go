@@ -0,0 +1,196 @@
+package gotransport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrQueueFull = errors.New("transport: send queue full")
+
+const (
+	// frames queued together are coalesced into one write up to this size
+	writeCoalesceSize = 64 * 1024
+	// max time to flush the queued frames when the transport is closed
+	closeFlushTimeout = time.Second
+)
+
+func (t *transport) WritePacketContext(ctx context.Context, packet Protocol) (n int, err error) {
+	if len(t.opts.WriteInterceptors) == 0 {
+		return t.enqueue(ctx, packet)
+	}
+	var handler WriteHandler = func(transport Transport, packet Protocol) (int, error) {
+		return t.enqueue(ctx, packet)
+	}
+	for i := len(t.opts.WriteInterceptors) - 1; i >= 0; i-- {
+		handler = t.opts.WriteInterceptors[i](handler)
+	}
+	return handler(t, packet)
+}
+
+// enqueue encodes the packet and queues it to the writer goroutine.
+func (t *transport) enqueue(ctx context.Context, packet Protocol) (n int, err error) {
+	// wait for the handshake
+	select {
+	case <-t.ready:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-t.closing:
+		return 0, ErrClosed
+	}
+
+	// the credits are taken out of the send lock, so the
+	// control frames are not held up by a writer waiting
+	if err := t.acquireCredits(ctx, packet); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			t.releaseCredits(packet)
+		}
+	}()
+
+	n, err = t.queue(ctx, packet)
+	if err == ErrQueueFull && t.opts.SendQueuePolicy == QueueClose {
+		// out of the send lock, which the closing writer takes
+		t.close(ErrQueueFull)
+	}
+	return n, err
+}
+
+// queue encodes the packet and puts it in the send queue, encoding and
+// queueing are serialized, so the frames are written in the same order
+// as they were encoded.
+func (t *transport) queue(ctx context.Context, packet Protocol) (int, error) {
+	select {
+	case t.sendMu <- struct{}{}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-t.closing:
+		return 0, ErrClosed
+	}
+	defer func() { <-t.sendMu }()
+
+	if b, ok := packet.(TransportBinder); ok {
+		b.BindTransport(t)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := packet.WriteTo(buf); err != nil {
+		return 0, err
+	}
+	data := buf.Bytes()
+
+	// a select picks any of the ready cases, a frame queued after
+	// closing would be reported as written but never drained
+	select {
+	case <-t.closing:
+		return 0, ErrClosed
+	default:
+	}
+	switch t.opts.SendQueuePolicy {
+	case QueueDrop, QueueClose:
+		select {
+		case t.sendCh <- data:
+		case <-t.closing:
+			return 0, ErrClosed
+		default:
+			return 0, ErrQueueFull
+		}
+	default:
+		select {
+		case t.sendCh <- data:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-t.closing:
+			return 0, ErrClosed
+		}
+	}
+	return len(data), nil
+}
+
+func (t *transport) startWriter() {
+	size := SendQueueSize
+	if t.opts.SendQueueSize > 0 {
+		size = t.opts.SendQueueSize
+	}
+	t.sendMu = make(chan struct{}, 1)
+	t.sendCh = make(chan []byte, size)
+	t.closing = make(chan struct{})
+	t.writerDone = make(chan struct{})
+	go func() {
+		if err := t.writeLoop(); err != nil {
+			t.close(err)
+		}
+	}()
+}
+
+// stopWriter flushes the queued frames within closeFlushTimeout,
+// then waits the writer goroutine to exit.
+func (t *transport) stopWriter() {
+	close(t.closing)
+	t.conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+	<-t.writerDone
+}
+
+// writeLoop is the only goroutine writing to the conn.
+func (t *transport) writeLoop() error {
+	defer close(t.writerDone)
+	var batch []byte
+	for {
+		var data []byte
+		select {
+		case data = <-t.sendCh:
+		case <-t.closing:
+			// the writes in flight may still queue a frame, wait for
+			// them, the send lock is never released so no one else does
+			t.sendMu <- struct{}{}
+			t.drain(batch[:0])
+			return nil
+		}
+
+		batch = append(batch[:0], data...)
+	coalesce:
+		for !t.datagram && len(batch) < writeCoalesceSize {
+			select {
+			case data = <-t.sendCh:
+				batch = append(batch, data...)
+			default:
+				break coalesce
+			}
+		}
+		if err := t.flush(batch); err != nil {
+			return err
+		}
+		if cap(batch) > 4*writeCoalesceSize {
+			batch = nil
+		}
+	}
+}
+
+// drain writes what is left in the queue, the transport is closing.
+func (t *transport) drain(batch []byte) {
+	for {
+		select {
+		case data := <-t.sendCh:
+			if t.datagram {
+				t.conn.Write(data)
+				continue
+			}
+			batch = append(batch, data...)
+		default:
+			if len(batch) > 0 {
+				t.conn.Write(batch)
+			}
+			return
+		}
+	}
+}
+
+func (t *transport) flush(batch []byte) error {
+	if t.opts.WriteTimeout > 0 {
+		t.conn.SetWriteDeadline(time.Now().Add(t.opts.WriteTimeout))
+	}
+	_, err := t.conn.Write(batch)
+	return err
+}